@@ -1,23 +1,36 @@
 #!/usr/bin/env bash
 # THIS SCRIPT IS A CLIENT OF THE MANAGEMENT SERVER
 # WHICH IS USED FOR MANAGING THE CURRENT CONTAINER INSIDE ITSELF.
+# The `client` binary built by build.sh does the same without curl, iproute2 and jq.
 
-GATEWAY=${GATEWAY:-"$(ip -j route | jq -r '.[] | select(.gateway != null) | .gateway')"}
-PORT=${PORT:-7684}
-
-if test -z "$GATEWAY"; then
-  echo "Did not find a valid gateway. Please explicitly set GATEWAY in environment(should be an IP)."
-  echo "(tips: also make sure iproute2 and jq installed.)"
+if test -z "$BUBBLE_MANAGER_TOKEN"; then
+  echo "BUBBLE_MANAGER_TOKEN is not set. Is enable-manager on for this workspace?"
   exit 1
 fi
 
+# The socket needs no gateway discovery, and identifies this container by itself.
+if test -S "$BUBBLE_MANAGER_SOCKET"; then
+  CURL_TARGET=(--unix-socket "$BUBBLE_MANAGER_SOCKET")
+  BASE_URL="http://bubble"
+else
+  GATEWAY=${GATEWAY:-"$(ip -j route | jq -r '.[] | select(.gateway != null) | .gateway')"}
+  PORT=${PORT:-7684}
+  if test -z "$GATEWAY"; then
+    echo "Did not find a valid gateway. Please explicitly set GATEWAY in environment(should be an IP)."
+    echo "(tips: also make sure iproute2 and jq installed.)"
+    exit 1
+  fi
+  CURL_TARGET=()
+  BASE_URL="http://$GATEWAY:$PORT"
+fi
+
 function send_signal(){
   if test -z "$1"; then
     echo "Signal cannot be empty."
     return
   fi
   echo "Sending signal $1 to manager..."
-  curl -X "$1" "http://$GATEWAY:$PORT/$2"
+  curl "${CURL_TARGET[@]}" -X "$1" -H "Authorization: Bearer $BUBBLE_MANAGER_TOKEN" "$BASE_URL/$2"
 }
 
 case "$1" in
@@ -30,18 +43,18 @@ case "$1" in
   "kill")
     send_signal "KILL"
   ;;
+  "snapshot")
+    send_signal "SNAPSHOT"
+  ;;
   "expose")
-    if test ! -z "$2"; then
-      echo "expose <hostPort> <toPort>"
-      return
-    elif test ! -z "$3"; then
+    if test -z "$2" || test -z "$3"; then
       echo "expose <hostPort> <toPort>"
-      return
+      exit 2
     fi
-    send_signal "PORT" "from=$2&to=$3"
+    send_signal "PORT" "?from=$2&to=$3"
   ;;
   *)
-    echo "Usage: bubble <destroy|stop|kill|expose>"
+    echo "Usage: bubble <destroy|stop|kill|snapshot|expose>"
     echo "  For port forwarding: expose <hostPort> <toPort>"
     echo "  Port forwarding must be explicitly enabled in daemon config."
   ;;
@@ -1,9 +1,10 @@
 #!/usr/bin/env bash
 
+version=$(git describe --tags --always --dirty 2>/dev/null || echo dev)
 for entry in *.go; do
   grep -q "func main()" $entry
   if [[ $? == 0 ]]; then
     echo "building $entry"
-    CGO_ENABLED=0 go build -o target/$(basename -s .go $entry) $entry
+    CGO_ENABLED=0 go build -ldflags "-X bubble/daemon.Version=$version" -o target/$(basename -s .go $entry) $entry
   fi
 done
@@ -0,0 +1,225 @@
+//go:build ignore
+
+// The client manages the current workspace from inside of it. Built by build.sh as target/client.
+package main
+
+import (
+	"bubble/client"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/go-units"
+)
+
+// Exit codes.
+const (
+	exitOk          = 0
+	exitFailed      = 1 // the manager refused or failed the request
+	exitUsage       = 2
+	exitUnreachable = 3 // the manager couldn't be found or reached
+)
+
+var jsonOutput = flag.Bool("json", false, "Print results as JSON")
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintln(out, "Usage: client [-json] <command>")
+	fmt.Fprintln(out, "Commands:")
+	fmt.Fprintln(out, "  status                          Show this workspace")
+	fmt.Fprintln(out, "  stop | destroy | kill           Stop, remove or kill this workspace")
+	fmt.Fprintln(out, "  snapshot                        Commit this workspace to an image")
+	fmt.Fprintln(out, "  list                            List forwarded ports")
+	fmt.Fprintln(out, "  expose <hostPort> <toPort>      Forward a host port to a port of this workspace")
+	fmt.Fprintln(out, "  unexpose <hostPort>             Close a forward")
+	fmt.Fprintln(out, "  message <text>                  Show a message to everyone attached to this workspace")
+	fmt.Fprintln(out, "Flags:")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	os.Exit(run(flag.Args()))
+}
+
+func run(args []string) int {
+	if len(args) == 0 {
+		usage()
+		return exitUsage
+	}
+	c, err := client.Discover()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUnreachable
+	}
+	ctx := context.Background()
+	switch command := args[0]; command {
+	case "status":
+		if len(args) != 1 {
+			break
+		}
+		self, err := c.Self(ctx)
+		if err != nil {
+			return fail(err)
+		}
+		if *jsonOutput {
+			return printJson(self)
+		}
+		printSelf(self)
+		return exitOk
+	case "stop", "destroy", "kill":
+		if len(args) != 1 {
+			break
+		}
+		actions := map[string]func(context.Context) error{
+			"stop":    c.Stop,
+			"destroy": c.Destroy,
+			"kill":    c.Kill,
+		}
+		if err := actions[command](ctx); err != nil {
+			return fail(err)
+		}
+		return exitOk
+	case "snapshot":
+		if len(args) != 1 {
+			break
+		}
+		tag, err := c.Snapshot(ctx)
+		if err != nil {
+			return fail(err)
+		}
+		if *jsonOutput {
+			return printJson(map[string]string{"tag": tag})
+		}
+		fmt.Println(tag)
+		return exitOk
+	case "list":
+		if len(args) != 1 {
+			break
+		}
+		ports, err := c.Ports(ctx)
+		if err != nil {
+			return fail(err)
+		}
+		if *jsonOutput {
+			return printJson(ports)
+		}
+		for _, port := range ports {
+			printPort(port)
+		}
+		return exitOk
+	case "expose":
+		if len(args) != 3 {
+			break
+		}
+		hostPort, err1 := strconv.Atoi(args[1])
+		toPort, err2 := strconv.Atoi(args[2])
+		if err1 != nil || err2 != nil {
+			break
+		}
+		forward, err := c.Expose(ctx, hostPort, toPort)
+		if err != nil {
+			return fail(err)
+		}
+		if *jsonOutput {
+			return printJson(forward)
+		}
+		printPort(*forward)
+		return exitOk
+	case "unexpose":
+		if len(args) != 2 {
+			break
+		}
+		hostPort, err := strconv.Atoi(args[1])
+		if err != nil {
+			break
+		}
+		if err := c.Unexpose(ctx, hostPort); err != nil {
+			return fail(err)
+		}
+		return exitOk
+	case "message":
+		if len(args) < 2 {
+			break
+		}
+		sessions, err := c.Message(ctx, strings.Join(args[1:], " "))
+		if err != nil {
+			return fail(err)
+		}
+		if *jsonOutput {
+			return printJson(map[string]int{"sessions": sessions})
+		}
+		fmt.Printf("Sent to %v sessions\n", sessions)
+		return exitOk
+	}
+	usage()
+	return exitUsage
+}
+
+func fail(err error) int {
+	var apiErr *client.APIError
+	if errors.As(err, &apiErr) {
+		if *jsonOutput {
+			_ = printJson(map[string]any{"error": apiErr})
+		} else {
+			fmt.Fprintln(os.Stderr, apiErr.Message)
+		}
+		return exitFailed
+	}
+	fmt.Fprintf(os.Stderr, "Failed to reach the manager: %v\n", err)
+	return exitUnreachable
+}
+
+func printJson(value any) int {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(value); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailed
+	}
+	return exitOk
+}
+
+func printPort(port client.PortForward) {
+	if port.PublicAddress != "" {
+		fmt.Printf("%v -> %v (%v)\n", port.HostPort, port.ContainerPort, port.PublicAddress)
+	} else {
+		fmt.Printf("%v -> %v\n", port.HostPort, port.ContainerPort)
+	}
+}
+
+func printSelf(self *client.Self) {
+	fmt.Printf("Workspace: %v (%v)\n", self.Workspace, self.State)
+	fmt.Printf("User:      %v\n", self.User)
+	fmt.Printf("Template:  %v\n", self.Template)
+	fmt.Printf("Image:     %v\n", self.Image)
+	for _, session := range self.Sessions {
+		who := session.User
+		if session.Key != "" {
+			who = session.Key
+		}
+		fmt.Printf("Session:   #%v %v since %v\n", session.Id, who, session.Connected.Local().Format(time.DateTime))
+	}
+	if self.Idle != nil {
+		if self.Idle.StopAt != nil {
+			fmt.Printf("Stops at:  %v, if idle\n", self.Idle.StopAt.Local().Format(time.DateTime))
+		}
+		if self.Idle.DestroyAt != nil {
+			fmt.Printf("Destroyed: %v, if idle\n", self.Idle.DestroyAt.Local().Format(time.DateTime))
+		}
+	}
+	if self.Quota != nil {
+		fmt.Printf("Disk:      %v of %v\n", units.HumanSize(float64(self.Quota.Used)), units.HumanSize(float64(self.Quota.Limit)))
+	}
+	for _, port := range self.Ports {
+		fmt.Print("Port:      ")
+		printPort(port)
+	}
+}
@@ -0,0 +1,273 @@
+// Package client talks to the bubble manager API from inside a workspace.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Environment variables set by bubble in workspaces with enable-manager, plus overrides.
+const (
+	TokenEnv  = "BUBBLE_MANAGER_TOKEN"
+	SocketEnv = "BUBBLE_MANAGER_SOCKET"
+	URLEnv    = "BUBBLE_MANAGER_URL"  // e.g. http://10.0.0.1:7684, skips discovery
+	PortEnv   = "BUBBLE_MANAGER_PORT" // port on the gateway, 7684 by default
+)
+
+const defaultPort = 7684
+
+type Client struct {
+	baseURL string
+	token   string
+	http    *http.Client
+}
+
+// APIError is a failure reported by the manager.
+type APIError struct {
+	Status  int
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%v (%v)", e.Message, e.Code)
+}
+
+type PortForward struct {
+	HostPort      int    `json:"host-port"`
+	ContainerPort int    `json:"container-port"`
+	PublicAddress string `json:"public-address,omitempty"`
+}
+
+type Session struct {
+	Id          uint64    `json:"id"`
+	User        string    `json:"user"`
+	Key         string    `json:"key,omitempty"`
+	Interactive bool      `json:"interactive"`
+	Connected   time.Time `json:"connected"`
+}
+
+type Idle struct {
+	LastActive time.Time  `json:"last-active"`
+	StopAt     *time.Time `json:"stop-at,omitempty"`
+	DestroyAt  *time.Time `json:"destroy-at,omitempty"`
+}
+
+type Quota struct {
+	Used    int64     `json:"used"`
+	Limit   int64     `json:"limit"`
+	Scanned time.Time `json:"scanned"`
+}
+
+type Self struct {
+	Id        string        `json:"id"`
+	Workspace string        `json:"workspace"`
+	User      string        `json:"user"`
+	Template  string        `json:"template"`
+	Image     string        `json:"image"`
+	State     string        `json:"state"`
+	Created   time.Time     `json:"created"`
+	Ports     []PortForward `json:"ports"`
+	Sessions  []Session     `json:"sessions,omitempty"`
+	Idle      *Idle         `json:"idle,omitempty"`
+	Quota     *Quota        `json:"quota,omitempty"`
+}
+
+// NewSocket connects to the manager through the unix socket mounted into the workspace.
+func NewSocket(path string, token string) *Client {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", path)
+		},
+	}
+	return &Client{
+		baseURL: "http://bubble",
+		token:   token,
+		http:    &http.Client{Transport: transport, Timeout: 5 * time.Minute},
+	}
+}
+
+// NewURL connects to the manager over TCP, e.g. http://10.0.0.1:7684.
+func NewURL(baseURL string, token string) *Client {
+	return &Client{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		token:   token,
+		http:    &http.Client{Timeout: 5 * time.Minute},
+	}
+}
+
+// Discover finds the manager from the environment: the socket if it's mounted, then $BUBBLE_MANAGER_URL,
+// then port 7684 (or $BUBBLE_MANAGER_PORT) of the default gateway.
+func Discover() (*Client, error) {
+	token := os.Getenv(TokenEnv)
+	if socket := os.Getenv(SocketEnv); socket != "" {
+		if info, err := os.Stat(socket); err == nil && info.Mode()&os.ModeSocket != 0 {
+			return NewSocket(socket, token), nil
+		}
+	}
+	if token == "" {
+		return nil, fmt.Errorf("%v is not set, is enable-manager on for this workspace?", TokenEnv)
+	}
+	if url := os.Getenv(URLEnv); url != "" {
+		return NewURL(url, token), nil
+	}
+	port := defaultPort
+	if value := os.Getenv(PortEnv); value != "" {
+		p, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %v: %v", PortEnv, value)
+		}
+		port = p
+	}
+	gateway, err := DefaultGateway()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find the manager, set %v: %v", URLEnv, err)
+	}
+	return NewURL("http://"+net.JoinHostPort(gateway, strconv.Itoa(port)), token), nil
+}
+
+// DefaultGateway reads the IPv4 default gateway from /proc/net/route.
+func DefaultGateway() (string, error) {
+	file, err := os.Open("/proc/net/route")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// Iface Destination Gateway Flags ...
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		raw, err := hex.DecodeString(fields[2])
+		if err != nil || len(raw) != 4 {
+			continue
+		}
+		// the address is in host byte order, which is little endian on every platform bubble runs on.
+		return net.IPv4(raw[3], raw[2], raw[1], raw[0]).String(), nil
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", errors.New("no default route")
+}
+
+// do sends a request and decodes the JSON answer into out, unless it's nil.
+func (c *Client) do(ctx context.Context, method string, path string, body any, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var failure struct {
+			Error APIError `json:"error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&failure); err != nil || failure.Error.Code == "" {
+			return &APIError{Status: resp.StatusCode, Code: "unknown", Message: resp.Status}
+		}
+		failure.Error.Status = resp.StatusCode
+		return &failure.Error
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (c *Client) Self(ctx context.Context) (*Self, error) {
+	var self Self
+	if err := c.do(ctx, http.MethodGet, "/v1/self", nil, &self); err != nil {
+		return nil, err
+	}
+	return &self, nil
+}
+
+func (c *Client) Stop(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "/v1/self/stop", nil, nil)
+}
+
+func (c *Client) Destroy(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "/v1/self/destroy", nil, nil)
+}
+
+func (c *Client) Kill(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "/v1/self/kill", nil, nil)
+}
+
+// Snapshot commits the workspace and returns the tag of the image.
+func (c *Client) Snapshot(ctx context.Context) (string, error) {
+	var result struct {
+		Tag string `json:"tag"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/v1/self/snapshot", nil, &result); err != nil {
+		return "", err
+	}
+	return result.Tag, nil
+}
+
+func (c *Client) Ports(ctx context.Context) ([]PortForward, error) {
+	var ports []PortForward
+	if err := c.do(ctx, http.MethodGet, "/v1/self/ports", nil, &ports); err != nil {
+		return nil, err
+	}
+	return ports, nil
+}
+
+// Expose forwards hostPort of the host to containerPort of the workspace.
+func (c *Client) Expose(ctx context.Context, hostPort int, containerPort int) (*PortForward, error) {
+	var forward PortForward
+	request := PortForward{HostPort: hostPort, ContainerPort: containerPort}
+	if err := c.do(ctx, http.MethodPost, "/v1/self/ports", request, &forward); err != nil {
+		return nil, err
+	}
+	return &forward, nil
+}
+
+func (c *Client) Unexpose(ctx context.Context, hostPort int) error {
+	return c.do(ctx, http.MethodDelete, "/v1/self/ports/"+strconv.Itoa(hostPort), nil, nil)
+}
+
+// Message shows text to the sessions attached to the workspace and returns how many got it.
+func (c *Client) Message(ctx context.Context, text string) (int, error) {
+	var result struct {
+		Sessions int `json:"sessions"`
+	}
+	request := map[string]string{"text": text}
+	if err := c.do(ctx, http.MethodPost, "/v1/self/message", request, &result); err != nil {
+		return 0, err
+	}
+	return result.Sessions, nil
+}
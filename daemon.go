@@ -2,8 +2,9 @@ package main
 
 import (
 	"bubble/daemon"
+	"bubble/daemon/admin"
+	"bubble/daemon/console"
 	"bubble/daemon/sshd"
-	"bufio"
 	"context"
 	"flag"
 	"fmt"
@@ -15,13 +16,24 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "admin" {
+		os.Exit(admin.Main(os.Args[2:]))
+	}
 	configPath := flag.String("config", "config.yml", "Path to config file")
 	needHelp := flag.Bool("help", false, "Show help")
+	replay := flag.String("replay", "", "Replay a session recording in this terminal and exit")
+	speed := flag.Float64("speed", 1, "Playback speed of -replay")
 	flag.Parse()
 	if *needHelp {
 		flag.Usage()
 		return
 	}
+	if *replay != "" {
+		if err := daemon.ReplayRecording(*replay, os.Stdout, *speed, 2*time.Second); err != nil {
+			log.Fatalf("Failed to replay %v: %v", *replay, err)
+		}
+		return
+	}
 	config, err := daemon.LoadConfig(configPath)
 	if err != nil {
 		log.Fatalf("Failed to open config file: %v", err)
@@ -34,48 +46,46 @@ func main() {
 	daemon.SetupNetworkGroup(dockerClient, config.Network)
 	ctx := context.Background()
 	sshs := sshd.CreateSshServer(ctx, dockerClient, config)
+	sshs.ConfigPath = *configPath
 
+	if err := sshs.Start(config.Address); err != nil {
+		log.Fatalf("Failed to start: %v", err)
+	}
 	sigChan := make(chan os.Signal, 1)
-	go sshs.Serve(config.Address)
+	go sshs.Serve()
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	go signalHandler(sshs, sigChan)
-	handleCommand()
-}
-
-func handleCommand() {
-	scanner := bufio.NewScanner(os.Stdin)
-	for {
-		scanner.Scan()
-		prompt := scanner.Text()
-		if err := scanner.Err(); err != nil {
-			log.Printf("Error reading input: %v", err)
-			continue
-		}
-		switch prompt {
-		case "stop":
-			pid := os.Getpid()
-			_ = syscall.Kill(pid, syscall.SIGTERM)
-			log.Println("Signal sent!")
-		}
-	}
-}
-
-func signalHandler(sshd *sshd.SshServerContext, sigChan chan os.Signal) {
-	sign := <-sigChan
-	switch sign {
-	case syscall.SIGINT, syscall.SIGTERM:
-		log.Println("Shutting down...")
+	// opened once startup can't fail anymore, since log.Fatalf would leave the terminal in raw mode.
+	cons, err := console.Open(sshs)
+	if err != nil {
+		log.Printf("Console disabled: %v", err)
+	} else {
 		go func() {
-			time.Sleep(8 * time.Second)
-			// The program isn't terminated.
-			_ = sshd
-			fmt.Println("Program isn't stopped!")
-			os.Exit(-1)
+			cons.Run()
+			cons.Close()
+			log.Println("Console closed, send SIGTERM to stop the daemon")
 		}()
-		sshd.StopSshServer()
-		os.Exit(0)
-	default:
-		log.Println("Unknown signal ", sign.String())
 	}
+	signalHandler(sshs, sigChan, cons)
+}
 
+// signalHandler blocks until the daemon is stopped by a signal.
+func signalHandler(sshd *sshd.SshServerContext, sigChan chan os.Signal, cons *console.Console) {
+	for sign := range sigChan {
+		switch sign {
+		case syscall.SIGINT, syscall.SIGTERM:
+			cons.Close()
+			log.Println("Shutting down...")
+			go func() {
+				time.Sleep(8 * time.Second)
+				// The program isn't terminated.
+				_ = sshd
+				fmt.Println("Program isn't stopped!")
+				os.Exit(-1)
+			}()
+			sshd.StopSshServer()
+			os.Exit(0)
+		default:
+			log.Println("Unknown signal ", sign.String())
+		}
+	}
 }
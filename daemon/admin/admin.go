@@ -0,0 +1,232 @@
+// Package admin serves the host admin API on a unix socket, which is guarded by its file mode.
+package admin
+
+import (
+	"bubble/daemon"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned by a Backend when the session or workspace doesn't exist.
+var ErrNotFound = errors.New("not found")
+
+type SessionInfo struct {
+	Id          uint64    `json:"id"`
+	User        string    `json:"user"`
+	Key         string    `json:"key,omitempty"`
+	Remote      string    `json:"remote"`
+	Workspace   string    `json:"workspace"`
+	Container   string    `json:"container"`
+	Interactive bool      `json:"interactive"`
+	Connected   time.Time `json:"connected"`
+}
+
+type ContainerInfo struct {
+	Id       string `json:"id"`
+	Name     string `json:"name"`
+	User     string `json:"user"`
+	Template string `json:"template"`
+	State    string `json:"state"`
+	Status   string `json:"status"`
+	Sessions int    `json:"sessions"`
+}
+
+type ForwardInfo struct {
+	Container     string `json:"container"`
+	HostPort      int    `json:"host-port"`
+	ContainerPort int    `json:"container-port"`
+	PublicAddress string `json:"public-address,omitempty"`
+}
+
+type UserInfo struct {
+	Name       string   `json:"name"`
+	Workspaces []string `json:"workspaces"`
+	Sessions   int      `json:"sessions"`
+}
+
+// MessageRequest selects sessions by user (or key name) and workspace. Empty filters match every session.
+type MessageRequest struct {
+	Text      string `json:"text"`
+	User      string `json:"user,omitempty"`
+	Workspace string `json:"workspace,omitempty"`
+}
+
+type MessageResult struct {
+	Sessions int `json:"sessions"`
+}
+
+type VersionInfo struct {
+	Version   string `json:"version"`
+	GoVersion string `json:"go-version"`
+}
+
+// Backend is what the admin API operates on, implemented by the SSH server.
+type Backend interface {
+	Sessions() []SessionInfo
+	Containers(ctx context.Context) ([]ContainerInfo, error)
+	Forwards() []ForwardInfo
+	Kick(id uint64) error
+	StopWorkspace(name string) error
+	DestroyWorkspace(name string) error
+	Reload() error
+	SendMessage(user string, workspace string, text string) int
+}
+
+type server struct {
+	backend Backend
+	mux     *http.ServeMux
+}
+
+// Serve listens on the admin socket until ctx is done. It does nothing if no socket is configured.
+func Serve(ctx context.Context, config daemon.AdminConfig, backend Backend) error {
+	if config.Socket == "" {
+		return nil
+	}
+	mode, err := config.FileMode()
+	if err != nil {
+		return err
+	}
+	_ = os.Remove(config.Socket)
+	l, err := net.Listen("unix", config.Socket)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(config.Socket, mode); err != nil {
+		_ = l.Close()
+		return err
+	}
+	s := &server{backend: backend, mux: http.NewServeMux()}
+	s.routes()
+	httpServer := &http.Server{Handler: s.mux}
+	go func() {
+		<-ctx.Done()
+		_ = httpServer.Close()
+	}()
+	go func() {
+		err := httpServer.Serve(l)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Admin server has been abnormally shut down: %v", err)
+		}
+	}()
+	log.Printf("Admin API listening on %v", config.Socket)
+	return nil
+}
+
+func (s *server) routes() {
+	s.mux.HandleFunc("GET /v1/sessions", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, http.StatusOK, s.backend.Sessions())
+	})
+	s.mux.HandleFunc("POST /v1/sessions/{id}/kick", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid session id %v", r.PathValue("id")))
+			return
+		}
+		s.answer(w, s.backend.Kick(id))
+	})
+	s.mux.HandleFunc("GET /v1/users", s.users)
+	s.mux.HandleFunc("GET /v1/containers", func(w http.ResponseWriter, r *http.Request) {
+		containers, err := s.backend.Containers(r.Context())
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJson(w, http.StatusOK, containers)
+	})
+	s.mux.HandleFunc("GET /v1/forwards", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, http.StatusOK, s.backend.Forwards())
+	})
+	s.mux.HandleFunc("POST /v1/workspaces/{name}/stop", func(w http.ResponseWriter, r *http.Request) {
+		s.answer(w, s.backend.StopWorkspace(r.PathValue("name")))
+	})
+	s.mux.HandleFunc("POST /v1/workspaces/{name}/destroy", func(w http.ResponseWriter, r *http.Request) {
+		s.answer(w, s.backend.DestroyWorkspace(r.PathValue("name")))
+	})
+	s.mux.HandleFunc("POST /v1/messages", func(w http.ResponseWriter, r *http.Request) {
+		var request MessageRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&request); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid body: %v", err))
+			return
+		}
+		if strings.TrimSpace(request.Text) == "" {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("text must not be empty"))
+			return
+		}
+		sessions := s.backend.SendMessage(request.User, request.Workspace, request.Text)
+		writeJson(w, http.StatusOK, MessageResult{Sessions: sessions})
+	})
+	s.mux.HandleFunc("POST /v1/reload", func(w http.ResponseWriter, r *http.Request) {
+		s.answer(w, s.backend.Reload())
+	})
+	s.mux.HandleFunc("GET /v1/version", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, http.StatusOK, VersionInfo{Version: daemon.Version, GoVersion: runtime.Version()})
+	})
+}
+
+// users gathers users from their workspace containers and sessions.
+func (s *server) users(w http.ResponseWriter, r *http.Request) {
+	containers, err := s.backend.Containers(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	users := make(map[string]*UserInfo)
+	user := func(name string) *UserInfo {
+		if _, ok := users[name]; !ok {
+			users[name] = &UserInfo{Name: name, Workspaces: make([]string, 0)}
+		}
+		return users[name]
+	}
+	for _, c := range containers {
+		info := user(c.User)
+		info.Workspaces = append(info.Workspaces, c.Name)
+	}
+	for _, session := range s.backend.Sessions() {
+		user(session.User).Sessions++
+	}
+	result := make([]UserInfo, 0, len(users))
+	for _, info := range users {
+		result = append(result, *info)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	writeJson(w, http.StatusOK, result)
+}
+
+// answer replies 204 on success, or the error with a matching status.
+func (s *server) answer(w http.ResponseWriter, err error) {
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errors.Is(err, ErrNotFound):
+		writeError(w, http.StatusNotFound, err)
+	default:
+		writeError(w, http.StatusInternalServerError, err)
+	}
+}
+
+func writeJson(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+type errorBody struct {
+	Error string `json:"error"`
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJson(w, status, errorBody{Error: err.Error()})
+}
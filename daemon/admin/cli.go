@@ -0,0 +1,149 @@
+package admin
+
+import (
+	"bubble/daemon"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Main runs `daemon admin`, returning the exit code.
+func Main(args []string) int {
+	flags := flag.NewFlagSet("admin", flag.ContinueOnError)
+	configPath := flags.String("config", "config.yml", "Path to config file, to find the admin socket")
+	socket := flags.String("socket", "", "Path to the admin socket, overrides the config")
+	jsonOutput := flags.Bool("json", false, "Print results as JSON")
+	flags.Usage = func() {
+		out := flags.Output()
+		fmt.Fprintln(out, "Usage: daemon admin [-config file] [-socket path] [-json] <command>")
+		fmt.Fprintln(out, "Commands:")
+		fmt.Fprintln(out, "  sessions                 List sessions")
+		fmt.Fprintln(out, "  users                    List users with workspaces or sessions")
+		fmt.Fprintln(out, "  containers               List workspace containers")
+		fmt.Fprintln(out, "  forwards                 List forwarded ports")
+		fmt.Fprintln(out, "  kick <session id>        Disconnect a session")
+		fmt.Fprintln(out, "  stop <workspace>         Stop a workspace, by workspace name or user")
+		fmt.Fprintln(out, "  destroy <workspace>      Remove a workspace container")
+		fmt.Fprintln(out, "  message all <text>       Show a message to every session")
+		fmt.Fprintln(out, "  message user <name> <text>")
+		fmt.Fprintln(out, "  message workspace <name> <text>")
+		fmt.Fprintln(out, "                           Show a message to sessions of a user or a workspace")
+		fmt.Fprintln(out, "  reload                   Reload the config of the daemon")
+		fmt.Fprintln(out, "  version                  Show the version of the daemon")
+		fmt.Fprintln(out, "Flags:")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	args = flags.Args()
+	if len(args) == 0 {
+		flags.Usage()
+		return 2
+	}
+	if *socket == "" {
+		config, err := daemon.LoadAdminConfig(*configPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read config: %v\n", err)
+			return 1
+		}
+		if config.Socket == "" {
+			fmt.Fprintln(os.Stderr, "The admin API isn't enabled, set admin.socket in the config")
+			return 1
+		}
+		*socket = config.Socket
+	}
+	c := NewClient(*socket)
+	var result any
+	var err error
+	switch command := args[0]; {
+	case command == "sessions" && len(args) == 1:
+		result, err = c.Sessions()
+	case command == "users" && len(args) == 1:
+		result, err = c.Users()
+	case command == "containers" && len(args) == 1:
+		result, err = c.Containers()
+	case command == "forwards" && len(args) == 1:
+		result, err = c.Forwards()
+	case command == "version" && len(args) == 1:
+		result, err = c.Version()
+	case command == "kick" && len(args) == 2:
+		id, parseErr := strconv.ParseUint(strings.TrimPrefix(args[1], "#"), 10, 64)
+		if parseErr != nil {
+			flags.Usage()
+			return 2
+		}
+		err = c.Kick(id)
+	case command == "stop" && len(args) == 2:
+		err = c.StopWorkspace(args[1])
+	case command == "destroy" && len(args) == 2:
+		err = c.DestroyWorkspace(args[1])
+	case command == "message" && len(args) >= 3 && args[1] == "all":
+		result, err = sendMessage(c, "", "", args[2:])
+	case command == "message" && len(args) >= 4 && args[1] == "user":
+		result, err = sendMessage(c, args[2], "", args[3:])
+	case command == "message" && len(args) >= 4 && args[1] == "workspace":
+		result, err = sendMessage(c, "", args[2], args[3:])
+	case command == "reload" && len(args) == 1:
+		err = c.Reload()
+	default:
+		flags.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if result == nil {
+		return 0
+	}
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(result)
+		return 0
+	}
+	printResult(result)
+	return 0
+}
+
+func sendMessage(c *Client, user string, workspace string, words []string) (MessageResult, error) {
+	sessions, err := c.SendMessage(user, workspace, strings.Join(words, " "))
+	return MessageResult{Sessions: sessions}, err
+}
+
+func printResult(result any) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+	switch result := result.(type) {
+	case []SessionInfo:
+		fmt.Fprintln(w, "ID\tUSER\tKEY\tWORKSPACE\tREMOTE\tCONNECTED")
+		for _, s := range result {
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n", s.Id, s.User, s.Key, s.Workspace, s.Remote, s.Connected.Local().Format(time.DateTime))
+		}
+	case []UserInfo:
+		fmt.Fprintln(w, "USER\tSESSIONS\tWORKSPACES")
+		for _, u := range result {
+			fmt.Fprintf(w, "%v\t%v\t%v\n", u.Name, u.Sessions, strings.Join(u.Workspaces, ","))
+		}
+	case []ContainerInfo:
+		fmt.Fprintln(w, "WORKSPACE\tUSER\tTEMPLATE\tSESSIONS\tSTATUS\tID")
+		for _, c := range result {
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%.12v\n", c.Name, c.User, c.Template, c.Sessions, c.Status, c.Id)
+		}
+	case []ForwardInfo:
+		fmt.Fprintln(w, "HOST PORT\tCONTAINER PORT\tCONTAINER\tPUBLIC ADDRESS")
+		for _, f := range result {
+			fmt.Fprintf(w, "%v\t%v\t%.12v\t%v\n", f.HostPort, f.ContainerPort, f.Container, f.PublicAddress)
+		}
+	case MessageResult:
+		fmt.Fprintf(w, "Sent to %v sessions\n", result.Sessions)
+	case VersionInfo:
+		fmt.Fprintf(w, "%v (%v)\n", result.Version, result.GoVersion)
+	}
+}
@@ -0,0 +1,117 @@
+package admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Client calls the admin API of a running daemon.
+type Client struct {
+	http *http.Client
+}
+
+func NewClient(socket string) *Client {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		},
+	}
+	return &Client{http: &http.Client{Transport: transport, Timeout: 5 * time.Minute}}
+}
+
+func (c *Client) do(method string, path string, body any, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, "http://bubble"+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var failure errorBody
+		if err := json.NewDecoder(resp.Body).Decode(&failure); err != nil || failure.Error == "" {
+			return fmt.Errorf("%v", resp.Status)
+		}
+		return fmt.Errorf("%v", failure.Error)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (c *Client) Sessions() ([]SessionInfo, error) {
+	var sessions []SessionInfo
+	err := c.do(http.MethodGet, "/v1/sessions", nil, &sessions)
+	return sessions, err
+}
+
+func (c *Client) Users() ([]UserInfo, error) {
+	var users []UserInfo
+	err := c.do(http.MethodGet, "/v1/users", nil, &users)
+	return users, err
+}
+
+func (c *Client) Containers() ([]ContainerInfo, error) {
+	var containers []ContainerInfo
+	err := c.do(http.MethodGet, "/v1/containers", nil, &containers)
+	return containers, err
+}
+
+func (c *Client) Forwards() ([]ForwardInfo, error) {
+	var forwards []ForwardInfo
+	err := c.do(http.MethodGet, "/v1/forwards", nil, &forwards)
+	return forwards, err
+}
+
+func (c *Client) Kick(id uint64) error {
+	return c.do(http.MethodPost, "/v1/sessions/"+strconv.FormatUint(id, 10)+"/kick", nil, nil)
+}
+
+func (c *Client) StopWorkspace(name string) error {
+	return c.do(http.MethodPost, "/v1/workspaces/"+url.PathEscape(name)+"/stop", nil, nil)
+}
+
+func (c *Client) DestroyWorkspace(name string) error {
+	return c.do(http.MethodPost, "/v1/workspaces/"+url.PathEscape(name)+"/destroy", nil, nil)
+}
+
+func (c *Client) Reload() error {
+	return c.do(http.MethodPost, "/v1/reload", nil, nil)
+}
+
+// SendMessage shows text to the selected sessions and returns how many got it.
+func (c *Client) SendMessage(user string, workspace string, text string) (int, error) {
+	var result MessageResult
+	request := MessageRequest{Text: text, User: user, Workspace: workspace}
+	err := c.do(http.MethodPost, "/v1/messages", request, &result)
+	return result.Sessions, err
+}
+
+func (c *Client) Version() (VersionInfo, error) {
+	var version VersionInfo
+	err := c.do(http.MethodGet, "/v1/version", nil, &version)
+	return version, err
+}
@@ -0,0 +1,190 @@
+package daemon
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// WriteDirTar writes the content of dir as a tar stream, with paths relative to dir. Files are opened
+// through an os.Root, so a directory swapped for a symlink while walking can't make it read outside of dir.
+func WriteDirTar(dir string, w io.Writer) error {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	tw := tar.NewWriter(w)
+	err = fs.WalkDir(root.FS(), ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || name == "." {
+			return err
+		}
+		info, err := root.Lstat(name)
+		if err != nil {
+			return err
+		}
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = readlinkIn(root, name); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = name
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			file, err := root.Open(name)
+			if err != nil {
+				return err
+			}
+			_, err = io.CopyN(tw, file, header.Size)
+			file.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// ExtractTar restores a tar stream into dir, overwriting existing files. Entries are written through an
+// os.Root, so neither their names nor symlinks, even ones created while extracting, can lead out of dir.
+// Extracted files are owned by uid:gid.
+func ExtractTar(r io.Reader, dir string, uid int, gid int) error {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.Clean(filepath.FromSlash(header.Name))
+		if name == "." {
+			continue
+		}
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("illegal path in archive: %v", header.Name)
+		}
+		mode := os.FileMode(header.Mode).Perm()
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = extractDir(root, name, mode|0700, uid, gid)
+		case tar.TypeReg:
+			err = extractFile(root, name, mode, tr, uid, gid)
+		case tar.TypeSymlink:
+			err = extractSymlink(root, name, header.Linkname, uid, gid)
+		default:
+			// devices, fifos and hard links have no place in a workspace directory.
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to extract %v: %v", header.Name, err)
+		}
+	}
+}
+
+func extractDir(root *os.Root, name string, mode os.FileMode, uid int, gid int) error {
+	if err := mkdirAllIn(root, name, mode); err != nil {
+		return err
+	}
+	dir, err := root.Open(name)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Chown(uid, gid)
+}
+
+func extractFile(root *os.Root, name string, mode os.FileMode, content io.Reader, uid int, gid int) error {
+	if err := mkdirAllIn(root, filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	_ = root.Remove(name)
+	// O_EXCL also refuses a symlink put in place since the removal.
+	file, err := root.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := io.Copy(file, content); err != nil {
+		return err
+	}
+	return file.Chown(uid, gid)
+}
+
+func extractSymlink(root *os.Root, name string, target string, uid int, gid int) error {
+	if err := mkdirAllIn(root, filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	_ = root.Remove(name)
+	parent, err := root.Open(filepath.Dir(name))
+	if err != nil {
+		return err
+	}
+	defer parent.Close()
+	base := filepath.Base(name)
+	if err := unix.Symlinkat(target, int(parent.Fd()), base); err != nil {
+		return err
+	}
+	return unix.Fchownat(int(parent.Fd()), base, uid, gid, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+// mkdirAllIn is os.MkdirAll within a root.
+func mkdirAllIn(root *os.Root, name string, mode os.FileMode) error {
+	if name == "." {
+		return nil
+	}
+	if info, err := root.Stat(name); err == nil {
+		if !info.IsDir() {
+			return fmt.Errorf("%v is not a directory", name)
+		}
+		return nil
+	}
+	if err := mkdirAllIn(root, filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	if err := root.Mkdir(name, mode); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
+
+// readlinkIn reads a symlink within a root, relative to its parent directory so that no other symlink is followed.
+func readlinkIn(root *os.Root, name string) (string, error) {
+	parent, err := root.Open(filepath.Dir(name))
+	if err != nil {
+		return "", err
+	}
+	defer parent.Close()
+	buf := make([]byte, unix.PathMax)
+	n, err := unix.Readlinkat(int(parent.Fd()), filepath.Base(name), buf)
+	if err != nil {
+		return "", err
+	}
+	return string(buf[:n]), nil
+}
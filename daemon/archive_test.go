@@ -0,0 +1,124 @@
+package daemon
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type tarEntry struct {
+	name     string
+	typeflag byte
+	linkname string
+	content  string
+}
+
+func buildTar(t *testing.T, entries []tarEntry) *bytes.Buffer {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, entry := range entries {
+		header := &tar.Header{
+			Name:     entry.name,
+			Typeflag: entry.typeflag,
+			Linkname: entry.linkname,
+			Mode:     0644,
+			Size:     int64(len(entry.content)),
+		}
+		if entry.typeflag != tar.TypeReg {
+			header.Size = 0
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if header.Size > 0 {
+			if _, err := tw.Write([]byte(entry.content)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestExtractTarRejectsEscapes(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries func(outside string) []tarEntry
+	}{
+		{"parent directory", func(string) []tarEntry {
+			return []tarEntry{{name: "../escaped", typeflag: tar.TypeReg, content: "x"}}
+		}},
+		{"parent directory below a directory", func(string) []tarEntry {
+			return []tarEntry{{name: "a/../../escaped", typeflag: tar.TypeReg, content: "x"}}
+		}},
+		{"absolute path", func(outside string) []tarEntry {
+			return []tarEntry{{name: filepath.Join(outside, "escaped"), typeflag: tar.TypeReg, content: "x"}}
+		}},
+		{"write through a symlink to outside", func(outside string) []tarEntry {
+			return []tarEntry{
+				{name: "link", typeflag: tar.TypeSymlink, linkname: outside},
+				{name: "link/escaped", typeflag: tar.TypeReg, content: "x"},
+			}
+		}},
+		{"write through a relative symlink to outside", func(string) []tarEntry {
+			return []tarEntry{
+				{name: "link", typeflag: tar.TypeSymlink, linkname: "../outside"},
+				{name: "link/escaped", typeflag: tar.TypeReg, content: "x"},
+			}
+		}},
+		{"directory through a symlink to outside", func(outside string) []tarEntry {
+			return []tarEntry{
+				{name: "link", typeflag: tar.TypeSymlink, linkname: outside},
+				{name: "link/escaped/", typeflag: tar.TypeDir},
+			}
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parent := t.TempDir()
+			dir := filepath.Join(parent, "workspace")
+			outside := filepath.Join(parent, "outside")
+			for _, d := range []string{dir, outside} {
+				if err := os.Mkdir(d, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			archive := buildTar(t, test.entries(outside))
+			if err := ExtractTar(archive, dir, os.Getuid(), os.Getgid()); err == nil {
+				t.Errorf("expected the archive to be rejected")
+			}
+			for _, escaped := range []string{filepath.Join(parent, "escaped"), filepath.Join(outside, "escaped")} {
+				if _, err := os.Lstat(escaped); err == nil {
+					t.Errorf("%v was written outside of the directory", escaped)
+				}
+			}
+		})
+	}
+}
+
+func TestExtractTar(t *testing.T) {
+	dir := t.TempDir()
+	archive := buildTar(t, []tarEntry{
+		{name: "a/", typeflag: tar.TypeDir},
+		{name: "a/file", typeflag: tar.TypeReg, content: "hello"},
+		{name: "b/nested/file", typeflag: tar.TypeReg, content: "nested"},
+		{name: "link", typeflag: tar.TypeSymlink, linkname: "a/file"},
+	})
+	if err := ExtractTar(archive, dir, os.Getuid(), os.Getgid()); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"a/file": "hello", "b/nested/file": "nested", "link": "hello"} {
+		content, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != want {
+			t.Errorf("%v = %q, want %q", name, content, want)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/syslog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/docker/go-units"
+)
+
+// Record types.
+const (
+	AuthSuccess  = "auth.success"
+	AuthFailure  = "auth.failure"
+	SessionStart = "session.start"
+	SessionEnd   = "session.end"
+	Exec         = "exec"
+	Subsystem    = "subsystem"
+	Manager      = "manager"
+	PortForward  = "port-forward"
+	Admin        = "admin"
+)
+
+// Config of the audit log. It's disabled if neither a file nor syslog is set.
+type Config struct {
+	File      string `yaml:"file"`
+	MaxSize   string `yaml:"max-size"`  // the file is rotated when it grows beyond this, e.g. "100m"
+	MaxFiles  int    `yaml:"max-files"` // rotated files to keep
+	Syslog    bool   `yaml:"syslog"`
+	SyslogTag string `yaml:"syslog-tag"`
+}
+
+// Record is one line of the audit log. Fields which don't apply to a record type are left out.
+type Record struct {
+	Time        time.Time `json:"time"`
+	Type        string    `json:"type"`
+	User        string    `json:"user,omitempty"`
+	Key         string    `json:"key,omitempty"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	Remote      string    `json:"remote,omitempty"`
+	Session     uint64    `json:"session,omitempty"`
+	Workspace   string    `json:"workspace,omitempty"`
+	Container   string    `json:"container,omitempty"`
+	Command     []string  `json:"command,omitempty"`
+	Action      string    `json:"action,omitempty"`
+	Port        int       `json:"port,omitempty"`
+	TargetPort  int       `json:"target-port,omitempty"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// Logger writes audit records as JSON lines. A nil Logger discards everything.
+type Logger struct {
+	lock     sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+	syslog   *syslog.Writer
+}
+
+func New(config Config) (*Logger, error) {
+	if config.File == "" && !config.Syslog {
+		return nil, nil
+	}
+	logger := &Logger{
+		path:     config.File,
+		maxSize:  100 * units.MiB,
+		maxFiles: config.MaxFiles,
+	}
+	if config.MaxSize != "" {
+		size, err := units.RAMInBytes(config.MaxSize)
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid audit max-size %v", config.MaxSize)
+		}
+		logger.maxSize = size
+	}
+	if logger.maxFiles <= 0 {
+		logger.maxFiles = 5
+	}
+	if config.File != "" {
+		if err := logger.open(); err != nil {
+			return nil, err
+		}
+	}
+	if config.Syslog {
+		tag := config.SyslogTag
+		if tag == "" {
+			tag = "bubble"
+		}
+		writer, err := syslog.New(syslog.LOG_AUTH|syslog.LOG_INFO, tag)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to syslog: %v", err)
+		}
+		logger.syslog = writer
+	}
+	return logger, nil
+}
+
+func (l *Logger) open() error {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to open audit log: %v", err)
+	}
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+// rotate renames file to file.1, file.1 to file.2 and so on, dropping the oldest.
+func (l *Logger) rotate() error {
+	_ = l.file.Close()
+	l.file = nil
+	for i := l.maxFiles - 1; i > 0; i-- {
+		_ = os.Rename(fmt.Sprintf("%v.%v", l.path, i), fmt.Sprintf("%v.%v", l.path, i+1))
+	}
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		log.Printf("Failed to rotate audit log: %v", err)
+	}
+	return l.open()
+}
+
+// Record writes a record, filling in its time.
+func (l *Logger) Record(record Record) {
+	if l == nil {
+		return
+	}
+	record.Time = time.Now()
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Failed to encode audit record: %v", err)
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.syslog != nil {
+		if err := l.syslog.Info(string(line)); err != nil {
+			log.Printf("Failed to write audit record to syslog: %v", err)
+		}
+	}
+	if l.path == "" {
+		return
+	}
+	if l.file == nil || l.size+int64(len(line))+1 > l.maxSize && l.size > 0 {
+		var err error
+		if l.file == nil {
+			err = l.open()
+		} else {
+			err = l.rotate()
+		}
+		if err != nil {
+			log.Printf("Audit record lost: %v", err)
+			return
+		}
+	}
+	n, err := l.file.Write(append(line, '\n'))
+	l.size += int64(n)
+	if err != nil {
+		log.Printf("Failed to write audit record: %v", err)
+	}
+}
+
+func (l *Logger) Close() {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.path = ""
+	if l.file != nil {
+		_ = l.file.Close()
+		l.file = nil
+	}
+	if l.syslog != nil {
+		_ = l.syslog.Close()
+		l.syslog = nil
+	}
+}
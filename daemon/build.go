@@ -0,0 +1,171 @@
+package daemon
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+)
+
+// BuildConfig lets bubble build the workspace image itself instead of referencing a prebuilt one.
+// The image is tagged with a hash of the context, so it is rebuilt whenever the context changes.
+type BuildConfig struct {
+	Context    string            `yaml:"context"`
+	Dockerfile string            `yaml:"dockerfile"`
+	Args       map[string]string `yaml:"args"`
+	Repository string            `yaml:"repository"` // defaults to bubble-build/<template>
+}
+
+var buildLock sync.Mutex
+
+var repositoryUnsafeChars = regexp.MustCompile("[^a-z0-9]+")
+
+func defaultBuildRepository(templateName string) string {
+	name := strings.Trim(repositoryUnsafeChars.ReplaceAllString(strings.ToLower(templateName), "-"), "-")
+	if name == "" {
+		sum := sha256.Sum256([]byte(templateName))
+		name = "template-" + hex.EncodeToString(sum[:4])
+	}
+	return "bubble-build/" + name
+}
+
+// EnsureBuiltImage builds the image of the template if the current context hasn't been built yet,
+// and returns the tag to create containers from. Build output is reported line by line.
+func EnsureBuiltImage(ctx context.Context, dockerClient *client.Client, build *BuildConfig, report func(string)) (string, error) {
+	hash, err := hashBuildContext(build)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash build context: %v", err)
+	}
+	tag := build.Repository + ":" + hash[:12]
+
+	buildLock.Lock()
+	defer buildLock.Unlock()
+	if _, err := dockerClient.ImageInspect(ctx, tag); err == nil {
+		return tag, nil
+	} else if !client.IsErrNotFound(err) {
+		return "", fmt.Errorf("failed to inspect image %v: %v", tag, err)
+	}
+
+	report(fmt.Sprintf("Building image %v, this may take a while...", tag))
+	reader, writer := io.Pipe()
+	go func() {
+		_ = writer.CloseWithError(WriteDirTar(build.Context, writer))
+	}()
+	args := make(map[string]*string, len(build.Args))
+	for k, v := range build.Args {
+		value := v
+		args[k] = &value
+	}
+	resp, err := dockerClient.ImageBuild(ctx, reader, types.ImageBuildOptions{
+		Tags:       []string{tag},
+		Dockerfile: build.Dockerfile,
+		BuildArgs:  args,
+		Remove:     true,
+		Labels:     map[string]string{"bubble.build-context": build.Context},
+	})
+	if err != nil {
+		_ = reader.Close()
+		return "", fmt.Errorf("failed to build image: %v", err)
+	}
+	defer resp.Body.Close()
+	if err := renderBuildOutput(resp.Body, report); err != nil {
+		return "", fmt.Errorf("failed to build image: %v", err)
+	}
+	return tag, nil
+}
+
+func renderBuildOutput(stream io.Reader, report func(string)) error {
+	decoder := json.NewDecoder(stream)
+	for {
+		var message progressMessage
+		if err := decoder.Decode(&message); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err := message.err(); err != nil {
+			return err
+		}
+		text := message.Stream
+		if text == "" {
+			text = message.Status
+		}
+		for _, line := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+			if line != "" {
+				report(line)
+			}
+		}
+	}
+}
+
+// contextFiles lists files under a directory in a stable order.
+func contextFiles(dir string) ([]string, error) {
+	files := make([]string, 0)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != dir {
+			files = append(files, path)
+		}
+		return nil
+	})
+	sort.Strings(files)
+	return files, err
+}
+
+func hashBuildContext(build *BuildConfig) (string, error) {
+	hash := sha256.New()
+	_, _ = fmt.Fprintf(hash, "dockerfile=%v\n", build.Dockerfile)
+	keys := make([]string, 0, len(build.Args))
+	for k := range build.Args {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		_, _ = fmt.Fprintf(hash, "arg %v=%v\n", k, build.Args[k])
+	}
+	files, err := contextFiles(build.Context)
+	if err != nil {
+		return "", err
+	}
+	for _, path := range files {
+		info, err := os.Lstat(path)
+		if err != nil {
+			return "", err
+		}
+		rel, _ := filepath.Rel(build.Context, path)
+		_, _ = fmt.Fprintf(hash, "%v %v %v\n", rel, info.Mode(), info.Size())
+		if info.Mode().IsRegular() {
+			file, err := os.Open(path)
+			if err != nil {
+				return "", err
+			}
+			_, err = io.Copy(hash, file)
+			file.Close()
+			if err != nil {
+				return "", err
+			}
+		} else if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(path)
+			if err != nil {
+				return "", err
+			}
+			_, _ = fmt.Fprintf(hash, "-> %v\n", target)
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -1,51 +1,130 @@
 package daemon
 
 import (
+	"bubble/daemon/audit"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/goccy/go-yaml"
 )
 
 type Config struct {
-	Address         string                     `yaml:"address"`
-	Network         string                     `yaml:"network-group"`
-	Keys            map[string][]string        `yaml:"keys"`
-	AccessControl   map[string]AccessConfig    `yaml:"access-control"`
-	ServerKey       string                     `yaml:"server-key-file"`
-	WorkspaceParent string                     `yaml:"workspace-parent"`
-	GlobalShareDir  string                     `yaml:"global-share-dir"`
-	Runtime         string                     `yaml:"runtime"`
-	Manager         ManagerServer              `yaml:"manager"`
-	Templates       map[string]ContainerConfig `yaml:"templates"`
+	Address          string                     `yaml:"address"`
+	Network          string                     `yaml:"network-group"`
+	Keys             map[string][]string        `yaml:"keys"`
+	AccessControl    map[string]AccessConfig    `yaml:"access-control"`
+	ServerKey        string                     `yaml:"server-key-file"`
+	WorkspaceParent  string                     `yaml:"workspace-parent"`
+	GlobalShareDir   string                     `yaml:"global-share-dir"`
+	Runtime          string                     `yaml:"runtime"`
+	Manager          ManagerServer              `yaml:"manager"`
+	UidMap           map[string]string          `yaml:"uid-map"`
+	AllowedHostPaths []string                   `yaml:"allowed-host-paths"`
+	Groups           map[string]GroupConfig     `yaml:"groups"`
+	Registries       map[string]RegistryAuth    `yaml:"registries"`
+	Snapshots        SnapshotConfig             `yaml:"snapshots"`
+	QuotaOverrides   map[string]string          `yaml:"quota-overrides"`
+	QuotaScan        time.Duration              `yaml:"quota-scan-interval"`
+	UserNames        UserNameConfig             `yaml:"user-names"`
+	WorkspaceIds     map[string]string          `yaml:"workspace-ids"`
+	Workspaces       map[string]SharedWorkspace `yaml:"workspaces"`
+	Audit            audit.Config               `yaml:"audit"`
+	Admin            AdminConfig                `yaml:"admin"`
+	Templates        map[string]ContainerConfig `yaml:"templates"`
 }
 
 type ManagerServer struct {
 	Address string `yaml:"address"`
+	// CheckIp also requires requests to come from the address of the container holding the token.
+	CheckIp bool `yaml:"check-ip"`
+	// SocketDir enables a unix socket per container, at <socket-dir>/<workspace>/bubble.sock on the host
+	// and /run/bubble/bubble.sock in the container.
+	SocketDir string `yaml:"socket-dir"`
+}
+
+// AdminConfig enables the host admin API on a unix socket. Anyone who can open the socket is an admin.
+type AdminConfig struct {
+	Socket string `yaml:"socket"`
+	Mode   string `yaml:"mode"` // octal file mode of the socket, defaults to 0600
+}
+
+// FileMode parses the configured mode of the admin socket.
+func (c AdminConfig) FileMode() (os.FileMode, error) {
+	if c.Mode == "" {
+		return 0600, nil
+	}
+	mode, err := strconv.ParseUint(c.Mode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid admin socket mode %v", c.Mode)
+	}
+	return os.FileMode(mode), nil
+}
+
+// GroupConfig gathers named keys, e.g. a team, which share a directory between their workspaces.
+type GroupConfig struct {
+	Members     []string `yaml:"members"`
+	ShareDir    string   `yaml:"share-dir"`
+	ShareTarget string   `yaml:"share-target"` // defaults to /mnt/groups/<name>
+	ReadOnly    bool     `yaml:"read-only"`
+}
+
+// SharedWorkspace is a workspace that its members attach to by logging in as the workspace name.
+type SharedWorkspace struct {
+	Members  []string `yaml:"members"`  // key names, or @group
+	Template string   `yaml:"template"` // key of the template, defaults to the one matching the workspace name
 }
 
 type AccessConfig struct {
 	Patterns []string `yaml:"patterns"`
+	// Observe lists patterns of users whose sessions the key may watch read-only.
+	Observe []string `yaml:"observe"`
 }
 
 type ContainerConfig struct {
+	// Name is the key of the template in the config.
+	Name           string               `yaml:"-"`
 	EnableManager  bool                 `yaml:"enable-manager"`
 	Image          string               `yaml:"image"`
+	PullPolicy     string               `yaml:"pull-policy"`
+	Build          *BuildConfig         `yaml:"build"`
+	Hooks          *HooksConfig         `yaml:"hooks"`
+	Quota          *QuotaConfig         `yaml:"quota"`
+	Recording      *RecordingConfig     `yaml:"recording"`
 	Exec           []string             `yaml:"exec"`
 	Cmd            []string             `yaml:"cmd"`
 	Env            []string             `yaml:"env"`
 	Volumes        []string             `yaml:"volumes"`
+	Mounts         []MountConfig        `yaml:"mounts"`
 	Privilege      bool                 `yaml:"privilege"`
 	Rm             bool                 `yaml:"rm"`
 	PortForwarding *PortForwarderConfig `yaml:"port-forwarding"`
+	Resources      *ResourceConfig      `yaml:"resources"`
+	Security       *SecurityConfig      `yaml:"security"`
+	User           string               `yaml:"user"`
+	// WorkspaceTarget and ShareTarget are where the workspace data and global share are mounted.
+	WorkspaceTarget string `yaml:"workspace-target"`
+	ShareTarget     string `yaml:"share-target"`
+	ShareReadOnly   bool   `yaml:"share-read-only"`
+	// IdleStopAfter and DestroyAfter stop or remove a workspace after it has been idle for that long. Zero disables.
+	IdleStopAfter time.Duration `yaml:"idle-stop-after"`
+	DestroyAfter  time.Duration `yaml:"destroy-after"`
+	// WorkspaceOwner is the uid[:gid] given to the workspace data directory when bubble creates it.
+	WorkspaceOwner string `yaml:"workspace-owner"`
 }
 
 type PortForwarderConfig struct {
 	MinPort int `yaml:"min-port"`
 	MaxPort int `yaml:"max-port"`
+	// PublicHost is the host name or address at which users reach forwarded ports, shown to containers.
+	PublicHost string `yaml:"public-host"`
 }
 
 func LoadConfig(path *string) (*Config, error) {
@@ -61,6 +140,9 @@ func LoadConfig(path *string) (*Config, error) {
 		},
 		Templates:     make(map[string]ContainerConfig),
 		AccessControl: make(map[string]AccessConfig),
+		UidMap:        make(map[string]string),
+		Groups:        make(map[string]GroupConfig),
+		QuotaScan:     10 * time.Minute,
 	}
 	file, err := os.Open(*path)
 	if err != nil {
@@ -69,7 +151,7 @@ func LoadConfig(path *string) (*Config, error) {
 	defer file.Close()
 	decoder := yaml.NewDecoder(file)
 	if err := decoder.Decode(config); err != nil {
-		log.Fatalf("Failed to parse config file: %v", err)
+		return nil, fmt.Errorf("failed to parse config file: %v", err)
 	}
 	// clean path
 	if config.WorkspaceParent != "" {
@@ -88,6 +170,113 @@ func LoadConfig(path *string) (*Config, error) {
 		log.Printf("Global sharepoint: %s", config.GlobalShareDir)
 	}
 
+	for name, group := range config.Groups {
+		if group.ShareDir == "" {
+			continue
+		}
+		group.ShareDir, err = initAbsFolder(group.ShareDir)
+		if err != nil {
+			return nil, err
+		}
+		if group.ShareTarget == "" {
+			group.ShareTarget = "/mnt/groups/" + name
+		}
+		config.Groups[name] = group
+		log.Printf("Sharepoint of group %v: %s", name, group.ShareDir)
+	}
+
+	if err := config.validateUserNames(); err != nil {
+		return nil, err
+	}
+
+	for name, shared := range config.Workspaces {
+		if _, err := config.NormalizeUser(name); err != nil {
+			return nil, fmt.Errorf("invalid shared workspace name %v", name)
+		}
+		if _, ok := config.Templates[shared.Template]; shared.Template != "" && !ok {
+			return nil, fmt.Errorf("shared workspace %v: template %v doesn't exist", name, shared.Template)
+		}
+		for _, member := range shared.Members {
+			if group, isGroup := strings.CutPrefix(member, "@"); isGroup {
+				if _, ok := config.Groups[group]; !ok {
+					return nil, fmt.Errorf("shared workspace %v: group %v doesn't exist", name, group)
+				}
+			}
+		}
+	}
+
+	for user, limit := range config.QuotaOverrides {
+		if _, err := parseSize(limit); err != nil {
+			return nil, fmt.Errorf("invalid quota override of %v: %v", user, err)
+		}
+	}
+
+	for i, allowed := range config.AllowedHostPaths {
+		if config.AllowedHostPaths[i], err = filepath.Abs(allowed); err != nil {
+			return nil, err
+		}
+	}
+
+	for key, containerConfig := range config.Templates {
+		if containerConfig.WorkspaceTarget == "" {
+			containerConfig.WorkspaceTarget = "/mnt/data"
+		}
+		if containerConfig.ShareTarget == "" {
+			containerConfig.ShareTarget = "/mnt/share"
+		}
+		containerConfig.Name = key
+		if build := containerConfig.Build; build != nil {
+			if build.Context == "" {
+				return nil, fmt.Errorf("template %v: build.context is required", key)
+			}
+			if build.Context, err = filepath.Abs(build.Context); err != nil {
+				return nil, err
+			}
+			if stat, err := os.Stat(build.Context); err != nil || !stat.IsDir() {
+				return nil, fmt.Errorf("template %v: build context %v is not a directory", key, build.Context)
+			}
+			if build.Dockerfile == "" {
+				build.Dockerfile = "Dockerfile"
+			}
+			if build.Repository == "" {
+				build.Repository = defaultBuildRepository(key)
+			}
+		} else if containerConfig.Image == "" {
+			return nil, fmt.Errorf("template %v: either image or build is required", key)
+		}
+		if !validPullPolicy(containerConfig.PullPolicy) {
+			return nil, fmt.Errorf("template %v: unknown pull-policy %v", key, containerConfig.PullPolicy)
+		}
+		config.Templates[key] = containerConfig
+		if err := config.validateMounts(&containerConfig, false); err != nil {
+			return nil, fmt.Errorf("template %v: %v", key, err)
+		}
+		if containerConfig.Resources != nil {
+			if _, err := containerConfig.Resources.ToDocker(); err != nil {
+				return nil, fmt.Errorf("template %v: %v", key, err)
+			}
+		}
+		if containerConfig.Quota != nil {
+			if err := containerConfig.Quota.validate(); err != nil {
+				return nil, fmt.Errorf("template %v: %v", key, err)
+			}
+		}
+		if containerConfig.Recording != nil {
+			if err := containerConfig.Recording.validate(); err != nil {
+				return nil, fmt.Errorf("template %v: %v", key, err)
+			}
+		}
+		if containerConfig.Security != nil {
+			if err := containerConfig.Security.resolve(); err != nil {
+				return nil, fmt.Errorf("template %v: %v", key, err)
+			}
+		}
+	}
+
+	if _, err := config.Admin.FileMode(); err != nil {
+		return nil, err
+	}
+
 	if config.WorkspaceParent == "" {
 		for _, containerConfig := range config.Templates {
 			if containerConfig.EnableManager {
@@ -119,6 +308,33 @@ func initAbsFolder(relPath string) (string, error) {
 	return absPath, nil
 }
 
+// TemplateOf finds the template of a user, honouring the template of shared workspaces.
+func (c *Config) TemplateOf(user string) (*ContainerConfig, error) {
+	if shared, ok := c.Workspaces[user]; ok && shared.Template != "" {
+		containerConfig := c.Templates[shared.Template]
+		return &containerConfig, nil
+	}
+	return c.GetTemplateByUser(user)
+}
+
+// IsWorkspaceMember tells whether the key is a member of the shared workspace, directly or through a group.
+func (c *Config) IsWorkspaceMember(workspace string, key string) bool {
+	shared, ok := c.Workspaces[workspace]
+	if !ok || key == "" {
+		return false
+	}
+	for _, member := range shared.Members {
+		if group, isGroup := strings.CutPrefix(member, "@"); isGroup {
+			if slices.Contains(c.Groups[group].Members, key) {
+				return true
+			}
+		} else if member == key {
+			return true
+		}
+	}
+	return false
+}
+
 func (c *Config) GetTemplateByUser(user string) (*ContainerConfig, error) {
 	for key, containerConfig := range c.Templates {
 		matched, _ := regexp.Match(key, []byte(user))
@@ -129,11 +345,105 @@ func (c *Config) GetTemplateByUser(user string) (*ContainerConfig, error) {
 	return nil, fmt.Errorf("cannot find template for user %v", user)
 }
 
+// LookupUid resolves the uid-map entry of a key name, or the user name if the key isn't mapped.
+func (c *Config) LookupUid(user string, key string) (uid string, gid string) {
+	if mapping, ok := c.UidMap[key]; ok && key != "" {
+		return parseUidMapping(mapping)
+	}
+	if mapping, ok := c.UidMap[user]; ok {
+		return parseUidMapping(mapping)
+	}
+	return "", ""
+}
+
+// Expand returns a copy of the template with variables in env, volumes, mounts, cmd, exec, user and hooks substituted.
+func (c *ContainerConfig) Expand(vars *TemplateVars) *ContainerConfig {
+	expanded := *c
+	expanded.Env = vars.ExpandAll(c.Env)
+	expanded.Volumes = vars.ExpandAll(c.Volumes)
+	expanded.Cmd = vars.ExpandAll(c.Cmd)
+	expanded.Exec = vars.ExpandAll(c.Exec)
+	expanded.User = vars.Expand(c.User)
+	expanded.WorkspaceOwner = vars.Expand(c.WorkspaceOwner)
+	expanded.Hooks = c.Hooks.expand(vars)
+	expanded.Mounts = make([]MountConfig, len(c.Mounts))
+	for i, m := range c.Mounts {
+		m.Source = vars.Expand(m.Source)
+		m.Target = vars.Expand(m.Target)
+		expanded.Mounts[i] = m
+	}
+	return &expanded
+}
+
+// GroupsOf lists the groups which a key belongs to.
+func (c *Config) GroupsOf(key string) []string {
+	groups := make([]string, 0)
+	if key == "" {
+		return groups
+	}
+	for name, group := range c.Groups {
+		if slices.Contains(group.Members, key) {
+			groups = append(groups, name)
+		}
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+// GroupMounts binds the share directory of every group the key belongs to.
+func (c *Config) GroupMounts(key string) []MountConfig {
+	mounts := make([]MountConfig, 0)
+	for _, name := range c.GroupsOf(key) {
+		group := c.Groups[name]
+		if group.ShareDir == "" {
+			continue
+		}
+		mounts = append(mounts, MountConfig{
+			Source:   group.ShareDir,
+			Target:   group.ShareTarget,
+			ReadOnly: group.ReadOnly,
+		})
+	}
+	return mounts
+}
+
 func (c *AccessConfig) CanAccess(name string) bool {
-	for _, element := range c.Patterns {
+	return matchAny(c.Patterns, name)
+}
+
+func (c *AccessConfig) CanObserve(name string) bool {
+	return matchAny(c.Observe, name)
+}
+
+// CanObserve reports whether the named key was granted to watch sessions of user.
+func (c *Config) CanObserve(keyName string, user string) bool {
+	if keyName == "" {
+		return false
+	}
+	access, ok := c.AccessControl[keyName]
+	return ok && access.CanObserve(user)
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, element := range patterns {
 		if matched, err := regexp.Match(element, []byte(name)); err == nil && matched {
 			return true
 		}
 	}
 	return false
 }
+
+// LoadAdminConfig reads only the admin section of a config file, for the admin command.
+func LoadAdminConfig(path string) (AdminConfig, error) {
+	var config struct {
+		Admin AdminConfig `yaml:"admin"`
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return AdminConfig{}, err
+	}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return AdminConfig{}, fmt.Errorf("failed to parse config file: %v", err)
+	}
+	return config.Admin, nil
+}
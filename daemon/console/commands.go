@@ -0,0 +1,336 @@
+package console
+
+import (
+	"bubble/daemon"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/go-units"
+)
+
+var errUsage = errors.New("usage")
+
+type command struct {
+	usage string
+	help  string
+	run   func(c *Console, args []string) error
+	// complete returns candidates for the next argument, given the arguments before it.
+	complete func(c *Console, args []string) []string
+}
+
+var commands map[string]*command
+
+func init() {
+	commands = map[string]*command{
+		"help":       {help: "Show this help", run: helpCommand},
+		"sessions":   {help: "List sessions", run: sessionsCommand},
+		"kick":       {usage: "<user|#session>", help: "Disconnect sessions of a user, or one session", run: kickCommand, complete: completeKick},
+		"containers": {help: "List workspace containers", run: containersCommand},
+		"forwards":   {help: "List forwarded ports", run: forwardsCommand},
+		"reload":     {help: "Reload the config file", run: reloadCommand},
+		"broadcast":  {usage: "<message>", help: "Send a message to every session", run: broadcastCommand},
+		"message":    {usage: "<user|workspace> <name> <message>", help: "Send a message to sessions of a user or a workspace", run: messageCommand, complete: completeMessage},
+		"drain":      {usage: "[off]", help: "Refuse new connections and stop once the last one is closed", run: drainCommand, complete: completeDrain},
+		"snapshot":   {usage: "<user> [list|create|restore <tag>]", help: "Manage snapshots of a workspace", run: snapshotCommand, complete: completeSnapshot},
+		"recordings": {usage: "[workspace]", help: "List session recordings", run: recordingsCommand, complete: completeWorkspace},
+		"stop":       {help: "Stop the daemon", run: stopCommand},
+	}
+}
+
+func helpCommand(c *Console, args []string) error {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w := tabwriter.NewWriter(c.term, 0, 4, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(w, "%v %v\t%v\n", name, commands[name].usage, commands[name].help)
+	}
+	return w.Flush()
+}
+
+func sessionsCommand(c *Console, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	w := tabwriter.NewWriter(c.term, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tUSER\tKEY\tWORKSPACE\tREMOTE\tCONNECTED")
+	for _, s := range c.sshs.Sessions() {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n", s.Id, s.User, s.Key, s.Workspace, s.Remote, s.Connected.Format(time.DateTime))
+	}
+	fmt.Fprintf(w, "%v connections, draining: %v\n", c.sshs.Connections(), c.sshs.IsDraining())
+	return w.Flush()
+}
+
+func kickCommand(c *Console, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	if id, err := strconv.ParseUint(strings.TrimPrefix(args[0], "#"), 10, 64); err == nil {
+		return c.sshs.Kick(id)
+	}
+	kicked := 0
+	for _, s := range c.sshs.Sessions() {
+		if s.User == args[0] || s.Key == args[0] {
+			if err := c.sshs.Kick(s.Id); err == nil {
+				kicked++
+			}
+		}
+	}
+	fmt.Fprintf(c.term, "Kicked %v sessions.\n", kicked)
+	return nil
+}
+
+func completeKick(c *Console, args []string) []string {
+	if len(args) != 0 {
+		return nil
+	}
+	var candidates []string
+	for _, s := range c.sshs.Sessions() {
+		candidates = append(candidates, s.User, "#"+strconv.FormatUint(s.Id, 10))
+		if s.Key != "" {
+			candidates = append(candidates, s.Key)
+		}
+	}
+	return candidates
+}
+
+func containersCommand(c *Console, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	containers, err := c.sshs.Containers(context.Background())
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(c.term, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "WORKSPACE\tUSER\tTEMPLATE\tSESSIONS\tSTATUS\tID")
+	for _, ct := range containers {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%.12v\n", ct.Name, ct.User, ct.Template, ct.Sessions, ct.Status, ct.Id)
+	}
+	return w.Flush()
+}
+
+func forwardsCommand(c *Console, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	w := tabwriter.NewWriter(c.term, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST PORT\tCONTAINER PORT\tCONTAINER\tPUBLIC ADDRESS")
+	for _, f := range c.sshs.Forwards() {
+		fmt.Fprintf(w, "%v\t%v\t%.12v\t%v\n", f.HostPort, f.ContainerPort, f.Container, f.PublicAddress)
+	}
+	return w.Flush()
+}
+
+func reloadCommand(c *Console, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	return c.sshs.Reload()
+}
+
+func broadcastCommand(c *Console, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	fmt.Fprintf(c.term, "Sent to %v sessions.\n", c.sshs.Broadcast(strings.Join(args, " ")))
+	return nil
+}
+
+func messageCommand(c *Console, args []string) error {
+	if len(args) < 3 {
+		return errUsage
+	}
+	text := strings.Join(args[2:], " ")
+	var sent int
+	switch args[0] {
+	case "user":
+		sent = c.sshs.SendMessage(args[1], "", text)
+	case "workspace":
+		sent = c.sshs.SendMessage("", args[1], text)
+	default:
+		return errUsage
+	}
+	fmt.Fprintf(c.term, "Sent to %v sessions.\n", sent)
+	return nil
+}
+
+func completeMessage(c *Console, args []string) []string {
+	switch {
+	case len(args) == 0:
+		return []string{"user", "workspace"}
+	case len(args) == 1 && args[0] == "user":
+		var users []string
+		for _, s := range c.sshs.Sessions() {
+			users = append(users, s.User)
+		}
+		return users
+	case len(args) == 1 && args[0] == "workspace":
+		var workspaces []string
+		for _, s := range c.sshs.Sessions() {
+			workspaces = append(workspaces, s.Workspace)
+		}
+		return workspaces
+	}
+	return nil
+}
+
+func drainCommand(c *Console, args []string) error {
+	switch {
+	case len(args) == 0:
+		if c.sshs.IsDraining() {
+			return fmt.Errorf("already draining, %v connections left", c.sshs.Connections())
+		}
+		c.sshs.SetDraining(true)
+		log.Printf("Draining: new connections are refused, stopping once %v connections are closed", c.sshs.Connections())
+		go waitDrained(c)
+		return nil
+	case len(args) == 1 && args[0] == "off":
+		c.sshs.SetDraining(false)
+		log.Println("Stopped draining")
+		return nil
+	}
+	return errUsage
+}
+
+// waitDrained stops the daemon once draining has closed every connection.
+func waitDrained(c *Console) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !c.sshs.IsDraining() {
+			return
+		}
+		if c.sshs.Connections() <= 0 {
+			log.Println("Drained, stopping")
+			_ = syscall.Kill(os.Getpid(), syscall.SIGTERM)
+			return
+		}
+	}
+}
+
+func completeDrain(c *Console, args []string) []string {
+	if len(args) != 0 {
+		return nil
+	}
+	return []string{"off"}
+}
+
+func stopCommand(c *Console, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	return syscall.Kill(os.Getpid(), syscall.SIGTERM)
+}
+
+func snapshotCommand(c *Console, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	user, err := c.sshs.AppConfig.Load().NormalizeUser(args[0])
+	if err != nil {
+		return err
+	}
+	switch {
+	case len(args) == 1 || (args[1] == "list" && len(args) == 2):
+		snapshots, err := daemon.ListSnapshots(context.Background(), c.sshs.DockerClient, user)
+		if err != nil {
+			return fmt.Errorf("failed to list snapshots: %v", err)
+		}
+		for _, snapshot := range snapshots {
+			fmt.Fprintf(c.term, "%v\t%v\n", snapshot.Tag, snapshot.Created.Format(time.DateTime))
+		}
+	case args[1] == "create" && len(args) == 2:
+		if _, err := c.sshs.SnapshotWorkspace(user); err != nil {
+			return fmt.Errorf("failed to create snapshot: %v", err)
+		}
+	case args[1] == "restore" && len(args) == 3:
+		// restored with the key of the current workspace, so that ${key} in the template expands the same.
+		err := c.sshs.RestoreWorkspace(user, c.sshs.WorkspaceKey(user), args[2], func(line string) {
+			log.Println(line)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to restore snapshot: %v", err)
+		}
+	default:
+		return errUsage
+	}
+	return nil
+}
+
+func completeSnapshot(c *Console, args []string) []string {
+	switch len(args) {
+	case 0:
+		var users []string
+		if containers, err := c.sshs.Containers(context.Background()); err == nil {
+			for _, ct := range containers {
+				users = append(users, ct.User)
+			}
+		}
+		return users
+	case 1:
+		return []string{"list", "create", "restore"}
+	case 2:
+		if args[1] != "restore" {
+			return nil
+		}
+		user, err := c.sshs.AppConfig.Load().NormalizeUser(args[0])
+		if err != nil {
+			return nil
+		}
+		var tags []string
+		if snapshots, err := daemon.ListSnapshots(context.Background(), c.sshs.DockerClient, user); err == nil {
+			for _, snapshot := range snapshots {
+				tags = append(tags, snapshot.Tag)
+			}
+		}
+		return tags
+	}
+	return nil
+}
+
+func recordingsCommand(c *Console, args []string) error {
+	if len(args) > 1 {
+		return errUsage
+	}
+	workspace := ""
+	if len(args) == 1 {
+		workspace = args[0]
+	}
+	for _, dir := range c.sshs.AppConfig.Load().RecordingDirs() {
+		recordings, err := daemon.ListRecordings(dir, workspace)
+		if err != nil {
+			log.Printf("Failed to list recordings in %v: %v", dir, err)
+			continue
+		}
+		for _, recording := range recordings {
+			fmt.Fprintf(c.term, "%v\t%v\t%v\t%v\n", recording.Workspace, recording.Modified.Format(time.DateTime), units.HumanSize(float64(recording.Size)), recording.Path)
+		}
+	}
+	fmt.Fprintln(c.term, "Replay with: daemon -replay <path>")
+	return nil
+}
+
+func completeWorkspace(c *Console, args []string) []string {
+	if len(args) != 0 {
+		return nil
+	}
+	var workspaces []string
+	if containers, err := c.sshs.Containers(context.Background()); err == nil {
+		for _, ct := range containers {
+			workspaces = append(workspaces, ct.Name)
+		}
+	}
+	return workspaces
+}
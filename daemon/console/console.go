@@ -0,0 +1,153 @@
+// Package console reads admin commands from the terminal the daemon runs in.
+package console
+
+import (
+	"bubble/daemon/sshd"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/term"
+)
+
+// Console is a line editor with history and tab completion on stdin. It puts the terminal into raw mode,
+// so logs are written through it to keep the prompt intact.
+type Console struct {
+	sshs  *sshd.SshServerContext
+	term  *term.Terminal
+	state *term.State
+	close sync.Once
+}
+
+// Open starts a console if stdin and stdout are a terminal, which they aren't e.g. under systemd.
+func Open(sshs *sshd.SshServerContext) (*Console, error) {
+	stdin, stdout := int(os.Stdin.Fd()), int(os.Stdout.Fd())
+	if !term.IsTerminal(stdin) || !term.IsTerminal(stdout) {
+		return nil, fmt.Errorf("not a terminal")
+	}
+	state, err := term.MakeRaw(stdin)
+	if err != nil {
+		return nil, err
+	}
+	c := &Console{sshs: sshs, state: state}
+	c.term = term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{interruptReader{os.Stdin}, os.Stdout}, "> ")
+	if width, height, err := term.GetSize(stdout); err == nil && width > 0 && height > 0 {
+		_ = c.term.SetSize(width, height)
+	}
+	c.term.AutoCompleteCallback = c.complete
+	log.SetOutput(c.term)
+	return c, nil
+}
+
+// Run reads commands until stdin is closed or Ctrl-D is pressed.
+func (c *Console) Run() {
+	fmt.Fprintln(c.term, "Type help for a list of commands.")
+	for {
+		line, err := c.term.ReadLine()
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("Error reading input: %v", err)
+			}
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+		cmd, ok := commands[args[0]]
+		if !ok {
+			fmt.Fprintf(c.term, "Unknown command %v, type help for a list of commands.\n", args[0])
+			continue
+		}
+		if err := cmd.run(c, args[1:]); err == errUsage {
+			fmt.Fprintf(c.term, "Usage: %v %v\n", args[0], cmd.usage)
+		} else if err != nil {
+			fmt.Fprintln(c.term, err)
+		}
+	}
+}
+
+// Close gives the terminal back. It may be called more than once, and on a nil Console.
+func (c *Console) Close() {
+	if c == nil {
+		return
+	}
+	c.close.Do(func() {
+		log.SetOutput(os.Stderr)
+		_ = term.Restore(int(os.Stdin.Fd()), c.state)
+	})
+}
+
+// complete handles tab, completing the word before the cursor or listing the candidates.
+func (c *Console) complete(line string, pos int, key rune) (string, int, bool) {
+	if key != '\t' {
+		return "", 0, false
+	}
+	head := line[:pos]
+	words := strings.Fields(head)
+	if len(words) == 0 || strings.HasSuffix(head, " ") {
+		words = append(words, "")
+	}
+	word := words[len(words)-1]
+	var candidates []string
+	if len(words) == 1 {
+		for name := range commands {
+			candidates = append(candidates, name)
+		}
+	} else if cmd, ok := commands[words[0]]; ok && cmd.complete != nil {
+		candidates = cmd.complete(c, words[1:len(words)-1])
+	}
+	var matches []string
+	for _, candidate := range candidates {
+		if strings.HasPrefix(candidate, word) && !slices.Contains(matches, candidate) {
+			matches = append(matches, candidate)
+		}
+	}
+	if len(matches) == 0 {
+		return line, pos, true
+	}
+	sort.Strings(matches)
+	completed := commonPrefix(matches)
+	if len(matches) == 1 {
+		completed += " "
+	} else if completed == word {
+		fmt.Fprintln(c.term, strings.Join(matches, "  "))
+		return line, pos, true
+	}
+	head = head[:len(head)-len(word)] + completed
+	return head + line[pos:], len(head), true
+}
+
+func commonPrefix(words []string) string {
+	prefix := words[0]
+	for _, word := range words[1:] {
+		for !strings.HasPrefix(word, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
+
+// interruptReader turns Ctrl-C into SIGINT, as it was before the terminal went raw.
+type interruptReader struct {
+	reader io.Reader
+}
+
+func (r interruptReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if bytes.IndexByte(p[:n], 3) >= 0 {
+		_ = syscall.Kill(os.Getpid(), syscall.SIGINT)
+		n = copy(p, bytes.ReplaceAll(p[:n], []byte{3}, nil))
+	}
+	return n, err
+}
@@ -8,6 +8,8 @@ import (
 	"strings"
 
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
 )
@@ -18,6 +20,15 @@ const ContainerStatusPaused = "paused"
 const ContainerStatusExited = "exited"
 const ContainerStatusUp = "up"
 
+// Labels put on every container created by bubble.
+const (
+	LabelWorkspace = "bubble.workspace"
+	LabelTemplate  = "bubble.template"
+	LabelUser      = "bubble.user"
+	// LabelKey is the key the workspace was created with, to expand its template again outside of a session.
+	LabelKey = "bubble.key"
+)
+
 func SetupDockerClient() (*client.Client, error) {
 	var err error
 	dockerClient, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
@@ -90,6 +101,7 @@ func CreateContainerFromTemplate(
 	networkGroup string,
 	runtime string,
 	containerTemplate *ContainerConfig,
+	labels map[string]string,
 ) (string, error) {
 	ctx := context.Background()
 	containerConfig := &container.Config{
@@ -98,23 +110,56 @@ func CreateContainerFromTemplate(
 		Cmd:      containerTemplate.Cmd,
 		Hostname: containerName,
 		Env:      containerTemplate.Env,
+		User:     containerTemplate.User,
+		Labels:   labels,
 	}
-	var volumes []string
-	copy(volumes, containerTemplate.Volumes)
+	volumes := append([]string{}, containerTemplate.Volumes...)
 	if dataDir != "" {
-		volumes = append(volumes, dataDir+":/mnt/data")
+		volumes = append(volumes, dataDir+":"+containerTemplate.WorkspaceTarget)
 	}
 	if globalShareDir != "" {
-		volumes = append(volumes, globalShareDir+":/mnt/share")
+		share := globalShareDir + ":" + containerTemplate.ShareTarget
+		if containerTemplate.ShareReadOnly {
+			share += ":ro"
+		}
+		volumes = append(volumes, share)
+	}
+	mounts := make([]mount.Mount, 0, len(containerTemplate.Mounts))
+	for i := range containerTemplate.Mounts {
+		m, err := containerTemplate.Mounts[i].ToDocker()
+		if err != nil {
+			return "", fmt.Errorf("invalid mount: %v", err)
+		}
+		mounts = append(mounts, m)
 	}
 	hostConfig := &container.HostConfig{
 		Binds:      volumes,
+		Mounts:     mounts,
 		AutoRemove: containerTemplate.Rm,
 		Privileged: containerTemplate.Privilege,
 	}
 	if runtime != "" {
 		hostConfig.Runtime = runtime
 	}
+	if containerTemplate.Resources != nil {
+		resources, err := containerTemplate.Resources.ToDocker()
+		if err != nil {
+			return "", fmt.Errorf("invalid resource limits: %v", err)
+		}
+		hostConfig.Resources = resources
+	}
+	if security := containerTemplate.Security; security != nil {
+		securityOpts, err := security.securityOpts()
+		if err != nil {
+			return "", err
+		}
+		hostConfig.CapAdd = security.CapAdd
+		hostConfig.CapDrop = security.CapDrop
+		hostConfig.SecurityOpt = securityOpts
+		hostConfig.ReadonlyRootfs = security.ReadOnly
+		hostConfig.Tmpfs = security.Tmpfs
+		hostConfig.UsernsMode = container.UsernsMode(security.UsernsMode)
+	}
 	var networkConfig *network.NetworkingConfig = nil
 	if networkGroup != "" {
 		nwg := networkGroup
@@ -147,3 +192,46 @@ func CreateContainerFromTemplate(
 	}
 	return resp.ID, nil
 }
+
+// StopContainer stops a container gracefully, falling back to killing it. A container that is gone counts as stopped.
+func StopContainer(ctx context.Context, dockerClient *client.Client, containerId string) error {
+	err := dockerClient.ContainerStop(ctx, containerId, container.StopOptions{})
+	if client.IsErrNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		log.Printf("failed to stop container %v: %v", containerId, err)
+		err = dockerClient.ContainerKill(ctx, containerId, "KILL")
+		if err != nil && !client.IsErrNotFound(err) {
+			return fmt.Errorf("failed to kill container %v: %v", containerId, err)
+		}
+		log.Printf("killed container %v", containerId)
+	}
+	return nil
+}
+
+// DestroyContainer stops and removes a container. A container that is gone counts as removed.
+func DestroyContainer(ctx context.Context, dockerClient *client.Client, containerId string) error {
+	if err := StopContainer(ctx, dockerClient, containerId); err != nil {
+		return err
+	}
+	err := dockerClient.ContainerRemove(ctx, containerId, container.RemoveOptions{Force: true})
+	if err != nil && !client.IsErrNotFound(err) {
+		return fmt.Errorf("failed to remove container %v: %v", containerId, err)
+	}
+	return nil
+}
+
+// ListWorkspaceContainers lists containers created by bubble.
+func ListWorkspaceContainers(ctx context.Context, dockerClient *client.Client) ([]container.Summary, error) {
+	return dockerClient.ContainerList(ctx, container.ListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", LabelWorkspace)),
+	})
+}
+
+// ContainerGone tells if a container doesn't exist anymore, e.g. after `docker rm` or auto-removal.
+func ContainerGone(ctx context.Context, dockerClient *client.Client, containerId string) bool {
+	_, err := dockerClient.ContainerInspect(ctx, containerId)
+	return client.IsErrNotFound(err)
+}
@@ -1,52 +1,21 @@
 package forwarder
 
 import (
-	"bubble/daemon"
 	"context"
-	"encoding/binary"
 	"fmt"
-	"log"
-
 	"io"
+	"log"
 	"net"
+	"strconv"
 )
 
-const (
-	PortForwardRequestEvent = "PortForwardRequestEvent"
-)
-
-func NewForwardRequest(fromPort int, toPort int, dst string) *daemon.ServerEvent {
-	buf := make([]byte, 0)
-	buf = binary.LittleEndian.AppendUint16(buf, uint16(fromPort))
-	buf = binary.LittleEndian.AppendUint16(buf, uint16(toPort))
-	buf = append(buf, []byte(dst)...)
-	return daemon.CreateEventRaw(PortForwardRequestEvent, 0, buf)
-}
-
-func ForwardRequest(event *daemon.ServerEvent) (from int, to int, dst string) {
-	data := event.DataRaw().([]byte)
-	from = int(binary.LittleEndian.Uint16(data[:2]))
-	to = int(binary.LittleEndian.Uint16(data[2:4]))
-	dst = string(data[4:])
-	return from, to, dst
+// Listen opens the host port of a forward.
+func Listen(port int) (net.Listener, error) {
+	return net.Listen("tcp", fmt.Sprintf(":%d", port))
 }
 
-type PortForwarderConfig struct {
-	AllowLowest  int
-	AllowHighest int
-	EventChan    chan *daemon.ServerEvent
-}
-
-func (cfg *PortForwarderConfig) Start(from int, to int, dst string) {
-	cfg.EventChan <- NewForwardRequest(from, to, dst)
-}
-
-func PortForward(ctx context.Context, dst string, port int, toPort int) {
-	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
-	if err != nil {
-		log.Println("port forwarder failed to listen: ", err)
-		return
-	}
+// Serve forwards connections accepted by l to dst:toPort until ctx is done or l is closed.
+func Serve(ctx context.Context, l net.Listener, dst string, toPort int) {
 	closed := false
 	defer l.Close()
 	go func() {
@@ -56,19 +25,22 @@ func PortForward(ctx context.Context, dst string, port int, toPort int) {
 			_ = l.Close()
 		}
 	}()
-	log.Println("Port forwarder listening on: ", port, " to ", dst, ":", toPort)
+	log.Println("Port forwarder listening on: ", l.Addr(), " to ", dst, ":", toPort)
 	for {
 		conn, err := l.Accept()
 		if err != nil {
+			if closed || ctx.Err() != nil {
+				return
+			}
 			log.Println("port forwarder failed to accept: ", err)
-			if closed {
+			if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
 				return
 			}
 			continue
 		}
 		go func() {
 			defer conn.Close()
-			to, err := net.Dial("tcp", fmt.Sprintf("%s:%d", dst, toPort))
+			to, err := net.Dial("tcp", net.JoinHostPort(dst, strconv.Itoa(toPort)))
 			if err != nil {
 				log.Println("port forwarder failed to connect: ", err)
 				return
@@ -81,3 +53,12 @@ func PortForward(ctx context.Context, dst string, port int, toPort int) {
 		}()
 	}
 }
+
+func PortForward(ctx context.Context, dst string, port int, toPort int) {
+	l, err := Listen(port)
+	if err != nil {
+		log.Println("port forwarder failed to listen: ", err)
+		return
+	}
+	Serve(ctx, l, dst, toPort)
+}
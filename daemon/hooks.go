@@ -0,0 +1,222 @@
+package daemon
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+const (
+	HookPostCreate = "post-create"
+	HookPostStart  = "post-start"
+	HookPreAttach  = "pre-attach"
+	HookPreStop    = "pre-stop"
+)
+
+const defaultHookTimeout = 10 * time.Minute
+
+// hookWaitDelay bounds how long a killed host hook may keep its output open, e.g. through a background child.
+const hookWaitDelay = 2 * time.Second
+
+// HookConfig is a command run at a lifecycle point of the workspace, inside the container by default.
+type HookConfig struct {
+	Run            []string      `yaml:"run"`
+	Host           bool          `yaml:"host"` // run on the host instead, with BUBBLE_* variables in env
+	User           string        `yaml:"user"` // user inside the container, defaults to the template user
+	AbortOnFailure bool          `yaml:"abort-on-failure"`
+	Timeout        time.Duration `yaml:"timeout"`
+}
+
+type HooksConfig struct {
+	PostCreate []HookConfig `yaml:"post-create"`
+	PostStart  []HookConfig `yaml:"post-start"`
+	PreAttach  []HookConfig `yaml:"pre-attach"`
+	PreStop    []HookConfig `yaml:"pre-stop"`
+}
+
+func (h *HooksConfig) Stage(stage string) []HookConfig {
+	if h == nil {
+		return nil
+	}
+	switch stage {
+	case HookPostCreate:
+		return h.PostCreate
+	case HookPostStart:
+		return h.PostStart
+	case HookPreAttach:
+		return h.PreAttach
+	case HookPreStop:
+		return h.PreStop
+	}
+	return nil
+}
+
+func (h *HooksConfig) expand(vars *TemplateVars) *HooksConfig {
+	if h == nil {
+		return nil
+	}
+	expandStage := func(hooks []HookConfig) []HookConfig {
+		result := make([]HookConfig, len(hooks))
+		for i, hook := range hooks {
+			hook.Run = vars.ExpandAll(hook.Run)
+			hook.User = vars.Expand(hook.User)
+			result[i] = hook
+		}
+		return result
+	}
+	return &HooksConfig{
+		PostCreate: expandStage(h.PostCreate),
+		PostStart:  expandStage(h.PostStart),
+		PreAttach:  expandStage(h.PreAttach),
+		PreStop:    expandStage(h.PreStop),
+	}
+}
+
+// RunHooks runs the hooks of a stage in order, sending their output to report.
+// It stops at the first failing hook which has abort-on-failure set and returns its error.
+func RunHooks(
+	ctx context.Context,
+	dockerClient *client.Client,
+	containerId string,
+	template *ContainerConfig,
+	stage string,
+	vars *TemplateVars,
+	report func(string),
+) error {
+	for _, hook := range template.Hooks.Stage(stage) {
+		if len(hook.Run) == 0 {
+			continue
+		}
+		timeout := hook.Timeout
+		if timeout == 0 {
+			timeout = defaultHookTimeout
+		}
+		hookCtx, cancel := context.WithTimeout(ctx, timeout)
+		var err error
+		if hook.Host {
+			err = runHostHook(hookCtx, containerId, stage, hook, vars, report)
+		} else {
+			user := hook.User
+			if user == "" {
+				user = template.User
+			}
+			err = runContainerHook(hookCtx, dockerClient, containerId, hook.Run, user, report)
+		}
+		cancel()
+		if err != nil {
+			err = fmt.Errorf("%v hook %v failed: %v", stage, hook.Run, err)
+			if hook.AbortOnFailure {
+				return err
+			}
+			log.Println(err)
+			report(err.Error())
+		}
+	}
+	return nil
+}
+
+func runContainerHook(ctx context.Context, dockerClient *client.Client, containerId string, cmd []string, user string, report func(string)) error {
+	execResp, err := dockerClient.ContainerExecCreate(ctx, containerId, container.ExecOptions{
+		AttachStdout: true,
+		AttachStderr: true,
+		Cmd:          cmd,
+		User:         user,
+	})
+	if err != nil {
+		return err
+	}
+	hijackedResp, err := dockerClient.ContainerExecAttach(ctx, execResp.ID, container.ExecStartOptions{})
+	if err != nil {
+		return err
+	}
+	defer hijackedResp.Close()
+	// the hijacked connection ignores the context, so it's closed to stop reading once the hook times out.
+	stop := context.AfterFunc(ctx, hijackedResp.Close)
+	defer stop()
+	reader, writer := io.Pipe()
+	go func() {
+		_, err := stdcopy.StdCopy(writer, writer, hijackedResp.Reader)
+		_ = writer.CloseWithError(err)
+	}()
+	err = reportLines(reader, report)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		return err
+	}
+	inspect, err := dockerClient.ContainerExecInspect(ctx, execResp.ID)
+	if err != nil {
+		return err
+	}
+	if inspect.ExitCode != 0 {
+		return fmt.Errorf("exit code %v", inspect.ExitCode)
+	}
+	return nil
+}
+
+func runHostHook(ctx context.Context, containerId string, stage string, hook HookConfig, vars *TemplateVars, report func(string)) error {
+	cmd := exec.CommandContext(ctx, hook.Run[0], hook.Run[1:]...)
+	cmd.WaitDelay = hookWaitDelay
+	cmd.Env = append(os.Environ(),
+		"BUBBLE_HOOK="+stage,
+		"BUBBLE_CONTAINER_ID="+containerId,
+		"BUBBLE_USER="+vars.User,
+		"BUBBLE_WORKSPACE="+vars.Workspace,
+		"BUBBLE_KEY="+vars.Key,
+		"BUBBLE_WORKSPACE_DIR="+vars.WorkspaceDir,
+	)
+	reader, writer := io.Pipe()
+	cmd.Stdout = writer
+	cmd.Stderr = writer
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go func() {
+		_ = writer.CloseWithError(cmd.Wait())
+	}()
+	err := reportLines(reader, report)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func reportLines(reader io.Reader, report func(string)) error {
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		report(scanner.Text())
+	}
+	return scanner.Err()
+}
+
+// RunPreStopHooks runs pre-stop hooks of a container created by bubble, looking up its template by label.
+// Failures are only logged since they never prevent stopping.
+func RunPreStopHooks(ctx context.Context, dockerClient *client.Client, config *Config, containerId string) {
+	info, err := dockerClient.ContainerInspect(ctx, containerId)
+	if err != nil || info.Config == nil {
+		return
+	}
+	labels := info.Config.Labels
+	template, ok := config.Templates[labels[LabelTemplate]]
+	if !ok || template.Hooks == nil || len(template.Hooks.PreStop) == 0 {
+		return
+	}
+	vars := config.WorkspaceVars(labels[LabelUser], labels[LabelKey])
+	expanded := template.Expand(vars)
+	err = RunHooks(ctx, dockerClient, containerId, expanded, HookPreStop, vars, func(line string) {
+		log.Printf("(%v pre-stop) %v", vars.Workspace, line)
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,54 @@
+package daemon
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunHooksTimeout(t *testing.T) {
+	tests := []struct {
+		name string
+		run  []string
+	}{
+		{"sleeping hook", []string{"sleep", "10"}},
+		{"background child keeping the output open", []string{"sh", "-c", "sleep 10 & echo started; wait"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			template := &ContainerConfig{Hooks: &HooksConfig{PostStart: []HookConfig{{
+				Run:            test.run,
+				Host:           true,
+				AbortOnFailure: true,
+				Timeout:        100 * time.Millisecond,
+			}}}}
+			start := time.Now()
+			err := RunHooks(context.Background(), nil, "id", template, HookPostStart, &TemplateVars{}, func(string) {})
+			if err == nil || !strings.Contains(err.Error(), context.DeadlineExceeded.Error()) {
+				t.Errorf("expected the hook to time out, got %v", err)
+			}
+			if elapsed := time.Since(start); elapsed > hookWaitDelay+time.Second {
+				t.Errorf("hook returned after %v", elapsed)
+			}
+		})
+	}
+}
+
+func TestRunHooksFailure(t *testing.T) {
+	template := &ContainerConfig{Hooks: &HooksConfig{PostStart: []HookConfig{
+		{Run: []string{"sh", "-c", "echo hello"}, Host: true},
+		{Run: []string{"false"}, Host: true},
+		{Run: []string{"sh", "-c", "exit 3"}, Host: true, AbortOnFailure: true},
+	}}}
+	var lines []string
+	err := RunHooks(context.Background(), nil, "id", template, HookPostStart, &TemplateVars{}, func(line string) {
+		lines = append(lines, line)
+	})
+	if err == nil || !strings.Contains(err.Error(), "exit status 3") {
+		t.Errorf("expected the aborting hook to fail, got %v", err)
+	}
+	if len(lines) == 0 || lines[0] != "hello" {
+		t.Errorf("expected the output of the first hook, got %q", lines)
+	}
+}
@@ -0,0 +1,184 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-units"
+)
+
+const (
+	PullAlways       = "always"
+	PullIfNotPresent = "if-not-present"
+	PullNever        = "never"
+)
+
+// RegistryAuth holds credentials for a registry host, e.g. "ghcr.io" or "docker.io".
+type RegistryAuth struct {
+	Username      string `yaml:"username"`
+	Password      string `yaml:"password"`
+	IdentityToken string `yaml:"identity-token"`
+}
+
+func validPullPolicy(policy string) bool {
+	switch policy {
+	case "", PullAlways, PullIfNotPresent, PullNever:
+		return true
+	}
+	return false
+}
+
+// EnsureImage makes imageName available locally according to the pull policy.
+// Pull progress is reported line by line.
+func EnsureImage(
+	ctx context.Context,
+	dockerClient *client.Client,
+	imageName string,
+	policy string,
+	registries map[string]RegistryAuth,
+	report func(string),
+) error {
+	if policy != PullAlways {
+		_, err := dockerClient.ImageInspect(ctx, imageName)
+		if err == nil {
+			return nil
+		}
+		if !client.IsErrNotFound(err) {
+			return fmt.Errorf("failed to inspect image %v: %v", imageName, err)
+		}
+		if policy == PullNever {
+			return fmt.Errorf("image %v is not present and pull-policy is never", imageName)
+		}
+	}
+	options := image.PullOptions{}
+	named, err := reference.ParseNormalizedNamed(imageName)
+	if err != nil {
+		return fmt.Errorf("invalid image name %v: %v", imageName, err)
+	}
+	if auth, ok := registries[reference.Domain(named)]; ok {
+		options.RegistryAuth, err = registry.EncodeAuthConfig(registry.AuthConfig{
+			Username:      auth.Username,
+			Password:      auth.Password,
+			IdentityToken: auth.IdentityToken,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	report(fmt.Sprintf("Pulling image %v...", imageName))
+	stream, err := dockerClient.ImagePull(ctx, imageName, options)
+	if err != nil {
+		return fmt.Errorf("failed to pull image %v: %v", imageName, err)
+	}
+	defer stream.Close()
+	return renderPullProgress(stream, report)
+}
+
+// progressMessage is the subset of the engine's JSON message stream we care about.
+type progressMessage struct {
+	Stream         string `json:"stream"`
+	Status         string `json:"status"`
+	ID             string `json:"id"`
+	ProgressDetail struct {
+		Current int64 `json:"current"`
+		Total   int64 `json:"total"`
+	} `json:"progressDetail"`
+	Error       string `json:"error"`
+	ErrorDetail struct {
+		Message string `json:"message"`
+	} `json:"errorDetail"`
+	Aux json.RawMessage `json:"aux"`
+}
+
+func (m *progressMessage) err() error {
+	if m.ErrorDetail.Message != "" {
+		return errors.New(m.ErrorDetail.Message)
+	}
+	if m.Error != "" {
+		return errors.New(m.Error)
+	}
+	return nil
+}
+
+type layerProgress struct {
+	status  string
+	current int64
+	total   int64
+}
+
+// renderPullProgress prints status changes of each layer as they happen, and a summary of
+// downloaded bytes at most once per second so that slow terminals aren't flooded.
+func renderPullProgress(stream io.Reader, report func(string)) error {
+	decoder := json.NewDecoder(stream)
+	layers := make(map[string]*layerProgress)
+	lastSummary := time.Now()
+	for {
+		var message progressMessage
+		if err := decoder.Decode(&message); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("failed to read pull progress: %v", err)
+		}
+		if err := message.err(); err != nil {
+			return err
+		}
+		if message.ID == "" {
+			if message.Status != "" {
+				report(message.Status)
+			}
+			continue
+		}
+		layer, ok := layers[message.ID]
+		if !ok {
+			layer = &layerProgress{}
+			layers[message.ID] = layer
+		}
+		if message.ProgressDetail.Total > 0 {
+			layer.current = message.ProgressDetail.Current
+			layer.total = message.ProgressDetail.Total
+		}
+		if layer.status != message.Status {
+			layer.status = message.Status
+			if message.Status != "Downloading" && message.Status != "Extracting" {
+				report(fmt.Sprintf("%v: %v", message.ID, message.Status))
+			}
+		}
+		if time.Since(lastSummary) >= time.Second {
+			lastSummary = time.Now()
+			report(summarizeLayers(layers))
+		}
+	}
+}
+
+func summarizeLayers(layers map[string]*layerProgress) string {
+	var current, total int64
+	done := 0
+	active := make([]string, 0)
+	for id, layer := range layers {
+		current += layer.current
+		total += layer.total
+		switch layer.status {
+		case "Pull complete", "Already exists":
+			done++
+		case "Downloading", "Extracting":
+			active = append(active, id)
+		}
+	}
+	sort.Strings(active)
+	summary := fmt.Sprintf("[%v/%v layers] %v / %v", done, len(layers), units.HumanSize(float64(current)), units.HumanSize(float64(total)))
+	if len(active) > 0 {
+		summary += " (" + strings.Join(active, ", ") + ")"
+	}
+	return summary
+}
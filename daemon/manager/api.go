@@ -0,0 +1,223 @@
+package manager
+
+import (
+	"bubble/daemon"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/errdefs"
+)
+
+//go:embed openapi.json
+var openApiDocument []byte
+
+type containerKey struct{}
+
+// containerOf returns the container which sent an authorized request.
+func containerOf(r *http.Request) string {
+	return r.Context().Value(containerKey{}).(string)
+}
+
+// SelfInfo describes the workspace container that sent the request.
+type SelfInfo struct {
+	Id        string        `json:"id"`
+	Workspace string        `json:"workspace"`
+	User      string        `json:"user"`
+	Template  string        `json:"template"`
+	Image     string        `json:"image"`
+	State     string        `json:"state"`
+	Created   time.Time     `json:"created"`
+	Ports     []PortForward `json:"ports"`
+	*WorkspaceStatus
+}
+
+type portRequest struct {
+	HostPort      int `json:"host-port"`
+	ContainerPort int `json:"container-port"`
+}
+
+type messageRequest struct {
+	Text string `json:"text"`
+}
+
+type messageResult struct {
+	Sessions int `json:"sessions"`
+}
+
+type errorBody struct {
+	Error errorDetail `json:"error"`
+}
+
+type errorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (ctx *ManagerContext) apiRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /v1/self", ctx.apiSelf)
+	mux.HandleFunc("POST /v1/self/stop", ctx.apiAction("stop", ctx.stopContainer))
+	mux.HandleFunc("POST /v1/self/destroy", ctx.apiAction("destroy", ctx.destroyContainer))
+	mux.HandleFunc("POST /v1/self/kill", ctx.apiAction("kill", ctx.killContainer))
+	mux.HandleFunc("POST /v1/self/snapshot", ctx.apiSnapshot)
+	mux.HandleFunc("GET /v1/self/ports", ctx.apiListPorts)
+	mux.HandleFunc("POST /v1/self/ports", ctx.apiExposePort)
+	mux.HandleFunc("DELETE /v1/self/ports/{port}", ctx.apiUnexposePort)
+	mux.HandleFunc("POST /v1/self/message", ctx.apiMessage)
+	mux.HandleFunc("/v1/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, newApiError(http.StatusNotFound, "not_found", "no such endpoint: %v %v", r.Method, r.URL.Path))
+	})
+}
+
+func writeJson(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// writeError answers with the status of an apiError, or the one matching a Docker error.
+func writeError(w http.ResponseWriter, err error) {
+	apiErr := apiErrorOf(err)
+	writeJson(w, apiErr.status, errorBody{Error: errorDetail{Code: apiErr.code, Message: apiErr.message}})
+}
+
+// apiErrorOf maps an error to its HTTP status and code, from Docker's error kind unless it is an apiError already.
+func apiErrorOf(err error) *apiError {
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) {
+		switch {
+		case errdefs.IsNotFound(err):
+			apiErr = newApiError(http.StatusNotFound, "not_found", "%v", err)
+		case errdefs.IsConflict(err):
+			apiErr = newApiError(http.StatusConflict, "conflict", "%v", err)
+		case errdefs.IsUnavailable(err):
+			apiErr = newApiError(http.StatusServiceUnavailable, "unavailable", "%v", err)
+		default:
+			apiErr = newApiError(http.StatusInternalServerError, "internal", "%v", err)
+		}
+	}
+	return apiErr
+}
+
+func (ctx *ManagerContext) selfInfo(containerId string) (*SelfInfo, error) {
+	info, err := ctx.DockerClient.ContainerInspect(ctx.Context, containerId)
+	if err != nil {
+		return nil, err
+	}
+	created, _ := time.Parse(time.RFC3339Nano, info.Created)
+	labels := info.Config.Labels
+	return &SelfInfo{
+		Id:              info.ID,
+		Workspace:       labels[daemon.LabelWorkspace],
+		User:            labels[daemon.LabelUser],
+		Template:        labels[daemon.LabelTemplate],
+		Image:           info.Config.Image,
+		State:           info.State.Status,
+		Created:         created,
+		Ports:           ctx.portsOf(containerId),
+		WorkspaceStatus: ctx.statusOf(containerId, labels[daemon.LabelUser], labels[daemon.LabelTemplate]),
+	}, nil
+}
+
+func (ctx *ManagerContext) apiSelf(w http.ResponseWriter, r *http.Request) {
+	self, err := ctx.selfInfo(containerOf(r))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJson(w, http.StatusOK, self)
+}
+
+// apiAction runs an action on the container, answering 204 once it's done.
+func (ctx *ManagerContext) apiAction(name string, action func(containerId string) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		containerId := containerOf(r)
+		log.Printf("Received %v request from container %v", name, containerId)
+		err := action(containerId)
+		ctx.record(containerId, name, err)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (ctx *ManagerContext) apiSnapshot(w http.ResponseWriter, r *http.Request) {
+	containerId := containerOf(r)
+	log.Printf("Received snapshot request from container %v", containerId)
+	tag, err := ctx.snapshotContainer(containerId)
+	ctx.record(containerId, "snapshot", err)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJson(w, http.StatusCreated, map[string]string{"tag": tag})
+}
+
+func (ctx *ManagerContext) apiListPorts(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, ctx.portsOf(containerOf(r)))
+}
+
+func (ctx *ManagerContext) apiExposePort(w http.ResponseWriter, r *http.Request) {
+	containerId := containerOf(r)
+	var request portRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&request); err != nil {
+		writeError(w, newApiError(http.StatusBadRequest, "invalid_body", "invalid body: %v", err))
+		return
+	}
+	forward, err := ctx.openPort(containerId, r.RemoteAddr, request.HostPort, request.ContainerPort)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJson(w, http.StatusCreated, forward)
+}
+
+func (ctx *ManagerContext) apiUnexposePort(w http.ResponseWriter, r *http.Request) {
+	containerId := containerOf(r)
+	port, err := strconv.Atoi(r.PathValue("port"))
+	if err != nil {
+		writeError(w, newApiError(http.StatusBadRequest, "invalid_port", "invalid port %v", r.PathValue("port")))
+		return
+	}
+	err = ctx.unexposePort(containerId, port)
+	ctx.record(containerId, "unexpose", err)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiMessage shows a message to the sessions of the workspace.
+func (ctx *ManagerContext) apiMessage(w http.ResponseWriter, r *http.Request) {
+	containerId := containerOf(r)
+	var request messageRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&request); err != nil {
+		writeError(w, newApiError(http.StatusBadRequest, "invalid_body", "invalid body: %v", err))
+		return
+	}
+	if strings.TrimSpace(request.Text) == "" {
+		writeError(w, newApiError(http.StatusBadRequest, "invalid_body", "text must not be empty"))
+		return
+	}
+	provider := ctx.statusProvider()
+	if provider == nil {
+		writeError(w, newApiError(http.StatusServiceUnavailable, "unavailable", "sessions aren't known yet"))
+		return
+	}
+	sessions := provider.MessageWorkspace(containerId, request.Text)
+	ctx.record(containerId, "message", nil)
+	writeJson(w, http.StatusOK, messageResult{Sessions: sessions})
+}
+
+func withContainer(r *http.Request, containerId string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), containerKey{}, containerId))
+}
@@ -6,17 +6,20 @@ import (
 
 const (
 	ManagerContainerRegisteredEvent = "ManagerContainerRegistered"
+	ManagerContainerRemovedEvent    = "ManagerContainerRemoved"
 )
 
 type ContainerJoinedEvent struct {
 	containerId string
-	bridgeIp    string
+	bridgeIp    string // empty if the container isn't in the network
+	workspace   string
 }
 
-func NewContainerRegisterEvent(containerId string, bridgeIp string) *daemon.ServerEvent {
+func NewContainerRegisterEvent(containerId string, bridgeIp string, workspace string) *daemon.ServerEvent {
 	return daemon.CreateEventRaw(ManagerContainerRegisteredEvent, 0, ContainerJoinedEvent{
 		containerId: containerId,
 		bridgeIp:    bridgeIp,
+		workspace:   workspace,
 	})
 }
 
@@ -26,3 +29,14 @@ func ContainerRegisterEvent(event *daemon.ServerEvent) ContainerJoinedEvent {
 	}
 	return event.DataRaw().(ContainerJoinedEvent)
 }
+
+func NewContainerRemovedEvent(containerId string) *daemon.ServerEvent {
+	return daemon.CreateEventRaw(ManagerContainerRemovedEvent, 0, containerId)
+}
+
+func ContainerRemovedEvent(event *daemon.ServerEvent) string {
+	if event.Type() != ManagerContainerRemovedEvent {
+		panic(event.Type() + " is not a ContainerRemovedEvent")
+	}
+	return event.DataRaw().(string)
+}
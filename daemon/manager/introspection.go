@@ -0,0 +1,59 @@
+package manager
+
+import "time"
+
+// StatusProvider knows what the manager can't see from Docker, e.g. who is connected to a workspace,
+// and can reach those sessions.
+type StatusProvider interface {
+	WorkspaceStatus(containerId string, user string, template string) *WorkspaceStatus
+	// MessageWorkspace shows a message to sessions of the container, returning how many got it.
+	MessageWorkspace(containerId string, text string) int
+}
+
+type WorkspaceStatus struct {
+	Sessions []SessionInfo `json:"sessions"`
+	Idle     *IdleInfo     `json:"idle,omitempty"`
+	Quota    *QuotaInfo    `json:"quota,omitempty"`
+}
+
+type SessionInfo struct {
+	Id          uint64    `json:"id"`
+	User        string    `json:"user"`
+	Key         string    `json:"key,omitempty"`
+	Interactive bool      `json:"interactive"`
+	Connected   time.Time `json:"connected"`
+}
+
+// IdleInfo tells when the workspace is stopped or destroyed if nobody uses it meanwhile.
+type IdleInfo struct {
+	LastActive time.Time  `json:"last-active"`
+	StopAt     *time.Time `json:"stop-at,omitempty"`
+	DestroyAt  *time.Time `json:"destroy-at,omitempty"`
+}
+
+type QuotaInfo struct {
+	Used    int64     `json:"used"`
+	Limit   int64     `json:"limit"`
+	Scanned time.Time `json:"scanned"`
+}
+
+// SetStatusProvider completes GET /v1/self with the status known by the provider, and enables POST /v1/self/message.
+func (ctx *ManagerContext) SetStatusProvider(provider StatusProvider) {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	ctx.provider = provider
+}
+
+func (ctx *ManagerContext) statusProvider() StatusProvider {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	return ctx.provider
+}
+
+func (ctx *ManagerContext) statusOf(containerId string, user string, template string) *WorkspaceStatus {
+	provider := ctx.statusProvider()
+	if provider == nil {
+		return nil
+	}
+	return provider.WorkspaceStatus(containerId, user, template)
+}
@@ -2,7 +2,7 @@ package manager
 
 import (
 	"bubble/daemon"
-	"bubble/daemon/forwarder"
+	"bubble/daemon/audit"
 	"context"
 	"fmt"
 	"log"
@@ -10,6 +10,9 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/client"
@@ -21,146 +24,370 @@ const (
 	containerMethodStop       = "STOP"
 	containerMethodDestroy    = "DESTROY"
 	containerMethodExposePort = "PORT"
+	containerMethodSnapshot   = "SNAPSHOT"
+)
+
+const (
+	unknownTokenTTL  = 30 * time.Second
+	maxUnknownTokens = 1024
 )
 
 type ManagerContext struct {
 	DockerClient  *client.Client
+	AppConfig     *atomic.Pointer[daemon.Config]
+	Audit         *audit.Logger
 	Context       context.Context
 	IpToContainer map[string]string
-	shuttingDown  bool
-	listener      *net.Listener
-	forwarder     *forwarder.PortForwarderConfig
-}
+	// tokens caches which container the hash of a manager token belongs to.
+	tokens       map[string]string
+	sockets      map[string]*workspaceSocket
+	lock         sync.Mutex
+	shuttingDown atomic.Bool
+	listener     *net.Listener
+	ports        *portRegistry
+	mux          *http.ServeMux
+	provider     StatusProvider
+	bus          *eventbus.EventBus
 
-func (mctx *ManagerContext) AllowPortForwarding(forwarder *forwarder.PortForwarderConfig) {
-	mctx.forwarder = forwarder
+	// unknownTokens caches token hashes which belong to no container, until when they are looked up again.
+	unknownTokens map[string]time.Time
 }
 
+// StartManagementServer serves the manager API. appConfig is shared with sshd, which replaces it on reload.
 func StartManagementServer(
 	docker *client.Client,
-	config daemon.ManagerServer,
+	appConfig *atomic.Pointer[daemon.Config],
 	bus *eventbus.EventBus,
+	auditor *audit.Logger,
 	context context.Context) (*ManagerContext, error) {
+	config := appConfig.Load().Manager
 	ctx := ManagerContext{
-		docker,
-		context,
-		make(map[string]string, 16),
-		false,
-		nil,
-		nil,
+		DockerClient:  docker,
+		AppConfig:     appConfig,
+		Audit:         auditor,
+		Context:       context,
+		IpToContainer: make(map[string]string, 16),
+		tokens:        make(map[string]string, 16),
+		unknownTokens: make(map[string]time.Time, 16),
+		sockets:       make(map[string]*workspaceSocket, 16),
+		ports:         newPortRegistry(),
+		mux:           http.NewServeMux(),
+		bus:           bus,
 	}
+	ctx.apiRoutes(ctx.mux)
+	ctx.mux.HandleFunc("/", ctx.serveLegacy)
 	log.Printf("Starting management server")
 	bus.Subscribe(ManagerContainerRegisteredEvent, func(_ string, ev *daemon.ServerEvent) {
 		event := ContainerRegisterEvent(ev)
-		log.Println("(manager) Allowed ACCESS from container ", event.containerId, " at address ", event.bridgeIp)
-		ctx.IpToContainer[event.bridgeIp] = event.containerId
+		if event.bridgeIp != "" {
+			log.Println("(manager) Allowed ACCESS from container ", event.containerId, " at address ", event.bridgeIp)
+			ctx.lock.Lock()
+			ctx.IpToContainer[event.bridgeIp] = event.containerId
+			ctx.lock.Unlock()
+		}
+		ctx.ensureSocket(event.containerId, event.workspace)
 	})
-	l, err := net.Listen("tcp", config.Address)
-	if err != nil {
-		return nil, err
-	}
-	go func() {
-		ctx.listener = &l
-		err = http.Serve(l, &ctx)
-		if err != nil && !ctx.shuttingDown {
-			log.Println("Manager server has been abnormally shut down: ", err)
+	bus.Subscribe(ManagerContainerRemovedEvent, func(_ string, ev *daemon.ServerEvent) {
+		ctx.forgetContainer(ContainerRemovedEvent(ev))
+	})
+	ctx.restoreSockets()
+	if config.Address != "" {
+		l, err := net.Listen("tcp", config.Address)
+		if err != nil {
+			return nil, err
 		}
-	}()
+		ctx.listener = &l
+		go func() {
+			err := http.Serve(l, &ctx)
+			if err != nil && !ctx.shuttingDown.Load() {
+				log.Println("Manager server has been abnormally shut down: ", err)
+			}
+		}()
+	}
 	go func() {
 		select {
 		case <-context.Done():
-			ctx.shuttingDown = true
-			(*ctx.listener).Close()
+			ctx.shuttingDown.Store(true)
+			if ctx.listener != nil {
+				(*ctx.listener).Close()
+			}
+			ctx.closeSockets()
 		}
 	}()
 	return &ctx, nil
 }
 
 func (ctx *ManagerContext) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	ip := strings.Split(r.RemoteAddr, ":")[0]
-	containerId, ok := ctx.IpToContainer[ip]
-	if !ok {
-		log.Println("Denied access to management server from ", r.RemoteAddr)
+	if r.URL.Path == "/v1/openapi.json" && r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(openApiDocument)
+		return
+	}
+	containerId, err := ctx.authorize(r)
+	if err != nil {
+		log.Printf("Denied access to management server from %v: %v", r.RemoteAddr, err)
+		ctx.Audit.Record(audit.Record{
+			Type:   audit.Manager,
+			Remote: r.RemoteAddr,
+			Action: r.Method,
+			Error:  "access denied: " + err.Error(),
+		})
+		if strings.HasPrefix(r.URL.Path, "/v1/") {
+			writeError(w, newApiError(http.StatusUnauthorized, "unauthorized", "%v", err))
+			return
+		}
 		w.WriteHeader(403)
 		w.Write([]byte(""))
 		return
 	}
+	ctx.mux.ServeHTTP(w, withContainer(r, containerId))
+}
+
+// serveLegacy handles the custom verbs used before the /v1 API.
+func (ctx *ManagerContext) serveLegacy(w http.ResponseWriter, r *http.Request) {
+	containerId := containerOf(r)
+	var err error
 	switch r.Method {
 	case containerMethodStop:
 		log.Printf("Received STOP signal from container %v", containerId)
-		ctx.stopContainer(containerId)
+		err = ctx.stopContainer(containerId)
+		ctx.record(containerId, r.Method, err)
 	case containerMethodDestroy:
 		log.Printf("Received DESTROY signal from container %v", containerId)
-		ctx.destroyContainer(containerId)
+		err = ctx.destroyContainer(containerId)
+		ctx.record(containerId, r.Method, err)
 	case containerMethodKill:
 		log.Printf("Received KILL signal from container %v", containerId)
-		ctx.killContainer(containerId)
-	case containerMethodExposePort:
-		log.Printf("Receive PORT forwarding request from container %v", containerId)
-		if ctx.forwarder == nil {
-			w.WriteHeader(http.StatusMethodNotAllowed)
+		err = ctx.killContainer(containerId)
+		ctx.record(containerId, r.Method, err)
+	case containerMethodSnapshot:
+		log.Printf("Received SNAPSHOT request from container %v", containerId)
+		tag, err := ctx.snapshotContainer(containerId)
+		ctx.record(containerId, r.Method, err)
+		if err != nil {
+			log.Printf("Failed to snapshot container %v: %v", containerId, err)
+			writeLegacyError(w, err)
 			return
 		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(tag))
+		return
+	case containerMethodExposePort:
+		log.Printf("Receive PORT forwarding request from container %v", containerId)
 		err := r.ParseForm()
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			_, _ = w.Write([]byte("Invalid body"))
 			return
 		}
-		from := r.Form.Get("from")
-		fromPort, err := strconv.Atoi(from)
-		if err != nil || fromPort < ctx.forwarder.AllowLowest || fromPort > ctx.forwarder.AllowHighest {
+		fromPort, err := strconv.Atoi(r.Form.Get("from"))
+		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
-			_, _ = w.Write([]byte(fmt.Sprintf("From port %v isn't integer. Min: %v, max: %v", fromPort, ctx.forwarder.AllowLowest, ctx.forwarder.AllowHighest)))
+			_, _ = w.Write([]byte("Invalid source port"))
 			return
 		}
-		to := r.Form.Get("to")
-		toPort, err := strconv.Atoi(to)
-		if err != nil || (toPort < 1 || toPort > 65535) {
+		toPort, err := strconv.Atoi(r.Form.Get("to"))
+		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			_, _ = w.Write([]byte("Invalid destination port"))
 			return
 		}
-		ctx.forwarder.Start(fromPort, toPort, r.RemoteAddr)
+		if _, err := ctx.openPort(containerId, r.RemoteAddr, fromPort, toPort); err != nil {
+			writeLegacyError(w, err)
+			return
+		}
+	}
+	if err != nil {
+		writeLegacyError(w, err)
+		return
 	}
 	w.WriteHeader(http.StatusOK)
 }
 
-func (ctx *ManagerContext) IsShuttingDown() bool {
-	return ctx.shuttingDown
+// writeLegacyError answers a legacy request with the status writeError would use, and the message as body.
+func writeLegacyError(w http.ResponseWriter, err error) {
+	w.WriteHeader(apiErrorOf(err).status)
+	_, _ = w.Write([]byte(err.Error()))
 }
 
-func (ctx *ManagerContext) destroyContainer(containerId string) {
-	err := ctx.DockerClient.ContainerStop(ctx.Context, containerId, container.StopOptions{})
+// openPort exposes a port of the container and records it in the audit log.
+func (ctx *ManagerContext) openPort(containerId string, remote string, hostPort int, containerPort int) (*PortForward, error) {
+	forward, err := ctx.exposePort(containerId, hostPort, containerPort)
+	ctx.record(containerId, containerMethodExposePort, err)
 	if err != nil {
-		log.Printf("failed to stop container %v: %v", containerId, err)
+		return nil, err
+	}
+	log.Printf("(manager) Forwarding host port %v to port %v of container %v", hostPort, containerPort, containerId)
+	ctx.Audit.Record(audit.Record{
+		Type:       audit.PortForward,
+		Container:  containerId,
+		Remote:     remote,
+		Port:       hostPort,
+		TargetPort: containerPort,
+	})
+	return forward, nil
+}
 
-		err = ctx.DockerClient.ContainerKill(ctx.Context, containerId, "KILL")
-		if err != nil {
-			log.Printf("failed to kill container %v: %v", containerId, err)
-			return
-		} else {
-			log.Printf("killed container %v", containerId)
+// record writes a manager call to the audit log.
+func (ctx *ManagerContext) record(containerId string, action string, err error) {
+	record := audit.Record{
+		Type:      audit.Manager,
+		Container: containerId,
+		Action:    action,
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	ctx.Audit.Record(record)
+}
+
+// authorize finds the container by the token in the Authorization header, checking the source address if configured.
+func (ctx *ManagerContext) authorize(r *http.Request) (string, error) {
+	if containerId, ok := containerOfSocket(r); ok {
+		return containerId, nil
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return "", fmt.Errorf("no token")
+	}
+	containerId, err := ctx.containerOfToken(token)
+	if err != nil {
+		return "", err
+	}
+	if !ctx.AppConfig.Load().Manager.CheckIp {
+		return containerId, nil
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return "", err
+	}
+	ctx.lock.Lock()
+	registered, ok := ctx.IpToContainer[ip]
+	ctx.lock.Unlock()
+	if !ok {
+		// the daemon may have restarted since the container was registered.
+		containerIp, err := daemon.GetIpOfContainer(ctx.DockerClient, containerId)
+		if err != nil || containerIp != ip {
+			return "", fmt.Errorf("token used from an address of another container")
 		}
+		return containerId, nil
 	}
-	err = ctx.DockerClient.ContainerRemove(ctx.Context, containerId, container.RemoveOptions{Force: true})
+	if registered != containerId {
+		return "", fmt.Errorf("token used from an address of another container")
+	}
+	return containerId, nil
+}
+
+func (ctx *ManagerContext) containerOfToken(token string) (string, error) {
+	if !daemon.IsManagerToken(token) {
+		return "", fmt.Errorf("unknown token")
+	}
+	// containers are labeled with the hash of their token, so only hashes are compared and cached.
+	hash := daemon.HashManagerToken(token)
+	ctx.lock.Lock()
+	containerId, ok := ctx.tokens[hash]
+	retryAt, unknown := ctx.unknownTokens[hash]
+	ctx.lock.Unlock()
+	if ok {
+		return containerId, nil
+	}
+	if unknown && time.Now().Before(retryAt) {
+		return "", fmt.Errorf("unknown token")
+	}
+	containerId, err := daemon.FindContainerByTokenHash(ctx.Context, ctx.DockerClient, hash)
 	if err != nil {
-		log.Printf("failed to remove container %v: %v", containerId, err)
-		return
+		return "", fmt.Errorf("failed to look up token: %v", err)
+	}
+	if containerId == "" {
+		ctx.rememberUnknownToken(hash)
+		return "", fmt.Errorf("unknown token")
 	}
+	ctx.lock.Lock()
+	ctx.tokens[hash] = containerId
+	ctx.lock.Unlock()
+	return containerId, nil
 }
 
-func (ctx *ManagerContext) stopContainer(containerId string) {
+// rememberUnknownToken spares Docker from being asked about the same wrong token over and over.
+func (ctx *ManagerContext) rememberUnknownToken(hash string) {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	now := time.Now()
+	if len(ctx.unknownTokens) >= maxUnknownTokens {
+		for t, retryAt := range ctx.unknownTokens {
+			if now.After(retryAt) {
+				delete(ctx.unknownTokens, t)
+			}
+		}
+	}
+	if len(ctx.unknownTokens) < maxUnknownTokens {
+		ctx.unknownTokens[hash] = now.Add(unknownTokenTTL)
+	}
+}
+
+func (ctx *ManagerContext) forgetContainer(containerId string) {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	for hash, id := range ctx.tokens {
+		if id == containerId {
+			delete(ctx.tokens, hash)
+		}
+	}
+	for ip, id := range ctx.IpToContainer {
+		if id == containerId {
+			delete(ctx.IpToContainer, ip)
+		}
+	}
+	for workspace, socket := range ctx.sockets {
+		if socket.containerId == containerId {
+			_ = socket.listener.Close()
+			delete(ctx.sockets, workspace)
+		}
+	}
+	ctx.closePorts(containerId)
+}
+
+func (ctx *ManagerContext) IsShuttingDown() bool {
+	return ctx.shuttingDown.Load()
+}
+
+func (ctx *ManagerContext) destroyContainer(containerId string) error {
+	daemon.RunPreStopHooks(ctx.Context, ctx.DockerClient, ctx.AppConfig.Load(), containerId)
+	if err := daemon.DestroyContainer(ctx.Context, ctx.DockerClient, containerId); err != nil {
+		log.Println(err)
+		return err
+	}
+	ctx.forgetContainer(containerId)
+	// lets sshd forget the workspace too.
+	ctx.bus.Publish(ManagerContainerRemovedEvent, NewContainerRemovedEvent(containerId))
+	return nil
+}
+
+func (ctx *ManagerContext) stopContainer(containerId string) error {
+	daemon.RunPreStopHooks(ctx.Context, ctx.DockerClient, ctx.AppConfig.Load(), containerId)
 	err := ctx.DockerClient.ContainerStop(ctx.Context, containerId, container.StopOptions{})
 	if err != nil {
 		log.Printf("failed to stop container %v: %v", containerId, err)
 	}
+	return err
 }
 
-func (ctx *ManagerContext) killContainer(containerId string) {
+func (ctx *ManagerContext) snapshotContainer(containerId string) (string, error) {
+	info, err := ctx.DockerClient.ContainerInspect(ctx.Context, containerId)
+	if err != nil {
+		return "", err
+	}
+	user := info.Config.Labels[daemon.LabelUser]
+	if user == "" {
+		return "", fmt.Errorf("container %v isn't created by bubble", containerId)
+	}
+	return daemon.CreateSnapshot(ctx.Context, ctx.DockerClient, containerId, user, ctx.AppConfig.Load().Snapshots)
+}
+
+func (ctx *ManagerContext) killContainer(containerId string) error {
 	err := ctx.DockerClient.ContainerKill(ctx.Context, containerId, "KILL")
 	if err != nil {
 		log.Printf("failed to kill container %v: %v", containerId, err)
-		return
 	}
+	return err
 }
@@ -0,0 +1,174 @@
+package manager
+
+import (
+	"bubble/daemon"
+	"bubble/daemon/forwarder"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// PortForward is a host port forwarded to a port of a container.
+type PortForward struct {
+	HostPort      int `json:"host-port"`
+	ContainerPort int `json:"container-port"`
+	// PublicAddress is where the port is reached from outside, if the template sets a public host.
+	PublicAddress string `json:"public-address,omitempty"`
+	containerId   string
+	cancel        func()
+}
+
+// portRegistry tracks forwards opened through the manager, so host ports aren't handed out twice.
+type portRegistry struct {
+	lock     sync.Mutex
+	forwards map[int]*PortForward
+}
+
+func newPortRegistry() *portRegistry {
+	return &portRegistry{forwards: make(map[int]*PortForward)}
+}
+
+// apiError carries the status code an error is answered with.
+type apiError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *apiError) Error() string {
+	return e.message
+}
+
+func newApiError(status int, code string, format string, args ...any) *apiError {
+	return &apiError{status: status, code: code, message: fmt.Sprintf(format, args...)}
+}
+
+// portForwardingOf returns the port forwarding settings of the template the container was created from.
+func (ctx *ManagerContext) portForwardingOf(containerId string) (*daemon.PortForwarderConfig, error) {
+	info, err := ctx.DockerClient.ContainerInspect(ctx.Context, containerId)
+	if err != nil {
+		return nil, err
+	}
+	template, ok := ctx.AppConfig.Load().Templates[info.Config.Labels[daemon.LabelTemplate]]
+	if !ok || template.PortForwarding == nil {
+		return nil, nil
+	}
+	return template.PortForwarding, nil
+}
+
+// exposePort forwards hostPort on the host to containerPort of the container.
+func (ctx *ManagerContext) exposePort(containerId string, hostPort int, containerPort int) (*PortForward, error) {
+	config, err := ctx.portForwardingOf(containerId)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return nil, newApiError(http.StatusForbidden, "port_forwarding_disabled", "port forwarding isn't enabled for this workspace")
+	}
+	if hostPort < config.MinPort || hostPort > config.MaxPort || hostPort < 1 || hostPort > 65535 {
+		return nil, newApiError(http.StatusBadRequest, "invalid_port", "host port %v isn't allowed. Min: %v, max: %v", hostPort, config.MinPort, config.MaxPort)
+	}
+	if containerPort < 1 || containerPort > 65535 {
+		return nil, newApiError(http.StatusBadRequest, "invalid_port", "invalid container port %v", containerPort)
+	}
+	ip, err := daemon.GetIpOfContainer(ctx.DockerClient, containerId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get address of container: %v", err)
+	}
+	ports := ctx.ports
+	ports.lock.Lock()
+	defer ports.lock.Unlock()
+	if _, ok := ports.forwards[hostPort]; ok {
+		return nil, newApiError(http.StatusConflict, "port_in_use", "host port %v is already forwarded", hostPort)
+	}
+	l, err := forwarder.Listen(hostPort)
+	if err != nil {
+		return nil, newApiError(http.StatusConflict, "port_in_use", "failed to listen on host port %v: %v", hostPort, err)
+	}
+	forwardCtx, cancel := context.WithCancel(ctx.Context)
+	forward := &PortForward{
+		HostPort:      hostPort,
+		ContainerPort: containerPort,
+		containerId:   containerId,
+		PublicAddress: publicAddress(config.PublicHost, hostPort),
+		cancel:        cancel,
+	}
+	ports.forwards[hostPort] = forward
+	go forwarder.Serve(forwardCtx, l, ip, containerPort)
+	return forward, nil
+}
+
+// unexposePort closes a forward of the container.
+func (ctx *ManagerContext) unexposePort(containerId string, hostPort int) error {
+	ports := ctx.ports
+	ports.lock.Lock()
+	defer ports.lock.Unlock()
+	forward, ok := ports.forwards[hostPort]
+	if !ok || forward.containerId != containerId {
+		return newApiError(http.StatusNotFound, "not_found", "host port %v isn't forwarded to this workspace", hostPort)
+	}
+	forward.cancel()
+	delete(ports.forwards, hostPort)
+	return nil
+}
+
+// portsOf lists forwards of the container, ordered by host port.
+func (ctx *ManagerContext) portsOf(containerId string) []PortForward {
+	ports := ctx.ports
+	ports.lock.Lock()
+	defer ports.lock.Unlock()
+	forwards := make([]PortForward, 0)
+	for _, forward := range ports.forwards {
+		if forward.containerId == containerId {
+			forwards = append(forwards, *forward)
+		}
+	}
+	sort.Slice(forwards, func(i, j int) bool {
+		return forwards[i].HostPort < forwards[j].HostPort
+	})
+	return forwards
+}
+
+// Forwards lists forwards of all containers, ordered by host port.
+func (ctx *ManagerContext) Forwards() []PortForward {
+	ports := ctx.ports
+	ports.lock.Lock()
+	defer ports.lock.Unlock()
+	forwards := make([]PortForward, 0, len(ports.forwards))
+	for _, forward := range ports.forwards {
+		forwards = append(forwards, *forward)
+	}
+	sort.Slice(forwards, func(i, j int) bool {
+		return forwards[i].HostPort < forwards[j].HostPort
+	})
+	return forwards
+}
+
+// ContainerId returns the container the port is forwarded to.
+func (f PortForward) ContainerId() string {
+	return f.containerId
+}
+
+// closePorts closes all forwards of the container.
+func (ctx *ManagerContext) closePorts(containerId string) {
+	ports := ctx.ports
+	ports.lock.Lock()
+	defer ports.lock.Unlock()
+	for port, forward := range ports.forwards {
+		if forward.containerId == containerId {
+			forward.cancel()
+			delete(ports.forwards, port)
+		}
+	}
+}
+
+func publicAddress(host string, port int) string {
+	if host == "" {
+		return ""
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
@@ -0,0 +1,127 @@
+package manager
+
+import (
+	"bubble/daemon"
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+type socketContainerKey struct{}
+
+// containerOfSocket returns the container whose socket the request came from.
+func containerOfSocket(r *http.Request) (string, bool) {
+	containerId, ok := r.Context().Value(socketContainerKey{}).(string)
+	return containerId, ok
+}
+
+// workspaceSocket is the manager socket of a workspace, served for its current container.
+type workspaceSocket struct {
+	containerId string
+	listener    net.Listener
+}
+
+// ensureSocket listens on the manager socket of a container, unless it already does. A socket left by
+// a previous container of the workspace is closed first. Requests on the socket are from that container,
+// so they need no token.
+func (ctx *ManagerContext) ensureSocket(containerId string, workspace string) {
+	dir := ctx.AppConfig.Load().ManagerSocketDir(workspace)
+	if dir == "" {
+		return
+	}
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	if ctx.shuttingDown.Load() {
+		return
+	}
+	if previous, ok := ctx.sockets[workspace]; ok {
+		if previous.containerId == containerId {
+			return
+		}
+		_ = previous.listener.Close()
+		delete(ctx.sockets, workspace)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Printf("(manager) Failed to create socket directory of %v: %v", workspace, err)
+		return
+	}
+	path := filepath.Join(dir, daemon.ManagerSocketName)
+	l, err := ctx.listenSocket(path)
+	if err != nil {
+		log.Printf("(manager) Failed to listen on %v: %v", path, err)
+		return
+	}
+	ctx.sockets[workspace] = &workspaceSocket{containerId: containerId, listener: l}
+	server := &http.Server{
+		Handler: ctx,
+		BaseContext: func(_ net.Listener) context.Context {
+			return context.WithValue(ctx.Context, socketContainerKey{}, containerId)
+		},
+	}
+	go func() {
+		err := server.Serve(l)
+		if err != nil && !ctx.shuttingDown.Load() {
+			log.Printf("(manager) Socket of %v closed: %v", workspace, err)
+		}
+	}()
+	log.Printf("(manager) Listening on %v for container %v", path, containerId)
+}
+
+// listenSocket listens on a unix socket at path, which anyone may connect to since users in the container
+// aren't necessarily root. The directory of path is writable from the container, so the socket is created
+// and made accessible in a directory of the daemon, then renamed into place: chmod on path could follow
+// a symlink planted by the container.
+func (ctx *ManagerContext) listenSocket(path string) (net.Listener, error) {
+	private := filepath.Join(ctx.AppConfig.Load().Manager.SocketDir, ".bubble")
+	if err := os.MkdirAll(private, 0700); err != nil {
+		return nil, err
+	}
+	temp := filepath.Join(private, filepath.Base(filepath.Dir(path))+".sock")
+	_ = os.Remove(temp)
+	l, err := net.Listen("unix", temp)
+	if err != nil {
+		return nil, err
+	}
+	// the listener only knows the temporary path, and the socket is replaced by the next listener anyway.
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := os.Chmod(temp, 0666); err != nil {
+		_ = l.Close()
+		return nil, err
+	}
+	if err := os.Rename(temp, path); err != nil {
+		_ = l.Close()
+		_ = os.Remove(temp)
+		return nil, err
+	}
+	return l, nil
+}
+
+// restoreSockets listens again on the sockets of workspaces created before the daemon started.
+func (ctx *ManagerContext) restoreSockets() {
+	if ctx.AppConfig.Load().Manager.SocketDir == "" {
+		return
+	}
+	containers, err := daemon.ListWorkspaceContainers(ctx.Context, ctx.DockerClient)
+	if err != nil {
+		log.Printf("(manager) Failed to list workspaces: %v", err)
+		return
+	}
+	for _, c := range containers {
+		if c.Labels[daemon.LabelManagerTokenHash] == "" {
+			continue
+		}
+		ctx.ensureSocket(c.ID, c.Labels[daemon.LabelWorkspace])
+	}
+}
+
+func (ctx *ManagerContext) closeSockets() {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	for workspace, socket := range ctx.sockets {
+		_ = socket.listener.Close()
+		delete(ctx.sockets, workspace)
+	}
+}
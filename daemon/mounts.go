@@ -0,0 +1,203 @@
+package daemon
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types/mount"
+)
+
+// MountConfig is a structured alternative to the "src:dst[:opts]" volume strings.
+type MountConfig struct {
+	Type        string `yaml:"type"` // bind, volume or tmpfs. Defaults to bind.
+	Source      string `yaml:"source"`
+	Target      string `yaml:"target"`
+	ReadOnly    bool   `yaml:"read-only"`
+	Propagation string `yaml:"propagation"` // bind only
+	NoCopy      bool   `yaml:"no-copy"`     // volume only
+	TmpfsSize   string `yaml:"tmpfs-size"`  // tmpfs only
+	TmpfsMode   string `yaml:"tmpfs-mode"`  // tmpfs only, octal e.g. "1777"
+}
+
+func (m *MountConfig) mountType() mount.Type {
+	if m.Type == "" {
+		return mount.TypeBind
+	}
+	return mount.Type(m.Type)
+}
+
+func (m *MountConfig) ToDocker() (mount.Mount, error) {
+	result := mount.Mount{
+		Type:     m.mountType(),
+		Source:   m.Source,
+		Target:   m.Target,
+		ReadOnly: m.ReadOnly,
+	}
+	if !filepath.IsAbs(m.Target) {
+		return result, fmt.Errorf("mount target %v must be absolute", m.Target)
+	}
+	switch result.Type {
+	case mount.TypeBind:
+		if !filepath.IsAbs(m.Source) {
+			return result, fmt.Errorf("bind source %v must be absolute", m.Source)
+		}
+		if m.Propagation != "" {
+			propagation := mount.Propagation(m.Propagation)
+			if !slices.Contains(mount.Propagations, propagation) {
+				return result, fmt.Errorf("unknown propagation %v", m.Propagation)
+			}
+			result.BindOptions = &mount.BindOptions{Propagation: propagation}
+		}
+	case mount.TypeVolume:
+		if m.Source == "" {
+			return result, fmt.Errorf("volume mount to %v needs a name", m.Target)
+		}
+		if m.NoCopy {
+			result.VolumeOptions = &mount.VolumeOptions{NoCopy: true}
+		}
+	case mount.TypeTmpfs:
+		if m.Source != "" {
+			return result, fmt.Errorf("tmpfs mount to %v cannot have a source", m.Target)
+		}
+		size, err := parseSize(m.TmpfsSize)
+		if err != nil {
+			return result, fmt.Errorf("invalid tmpfs-size: %v", err)
+		}
+		mode, err := m.tmpfsMode()
+		if err != nil {
+			return result, err
+		}
+		result.TmpfsOptions = &mount.TmpfsOptions{SizeBytes: size, Mode: mode}
+	default:
+		return result, fmt.Errorf("unsupported mount type %v", m.Type)
+	}
+	return result, nil
+}
+
+// tmpfsMode parses the octal tmpfs-mode. The bits are passed on as is, like the docker CLI does, so that
+// the sticky bit of e.g. "1777" reaches the mount options.
+func (m *MountConfig) tmpfsMode() (os.FileMode, error) {
+	if m.TmpfsMode == "" {
+		return 0, nil
+	}
+	bits, err := strconv.ParseUint(m.TmpfsMode, 8, 32)
+	if err != nil || bits > 07777 {
+		return 0, fmt.Errorf("invalid tmpfs-mode %v", m.TmpfsMode)
+	}
+	return os.FileMode(bits), nil
+}
+
+// hostPathOfVolume returns the host side of a "src:dst[:opts]" volume, or "" for named volumes.
+func hostPathOfVolume(volume string) (string, error) {
+	parts := strings.Split(volume, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return "", fmt.Errorf("invalid volume %v", volume)
+	}
+	if !filepath.IsAbs(parts[0]) {
+		return "", nil
+	}
+	return parts[0], nil
+}
+
+// ValidateMounts checks that every host path an expanded template binds lies in allowed-host-paths.
+// An empty allowlist allows everything, see IsHostPathAllowed.
+func (c *Config) ValidateMounts(template *ContainerConfig) error {
+	return c.validateMounts(template, true)
+}
+
+// validateMounts checks the mounts of a template. Before expansion, host paths with variables are only
+// known once a user connects, so they are checked again by ValidateMounts then.
+func (c *Config) validateMounts(template *ContainerConfig, expanded bool) error {
+	for _, volume := range template.Volumes {
+		hostPath, err := hostPathOfVolume(volume)
+		if err != nil {
+			return err
+		}
+		if hostPath != "" && !expanded {
+			c.warnUnrestrictedHostPath(template, hostPath)
+		}
+		if !expanded && hasVariable(hostPath) {
+			continue
+		}
+		if hostPath != "" && !c.IsHostPathAllowed(hostPath) {
+			return fmt.Errorf("host path %v is not in allowed-host-paths", hostPath)
+		}
+	}
+	for i := range template.Mounts {
+		m := template.Mounts[i]
+		if !expanded && m.mountType() == mount.TypeBind {
+			c.warnUnrestrictedHostPath(template, m.Source)
+		}
+		deferred := !expanded && m.mountType() == mount.TypeBind && hasVariable(m.Source)
+		if deferred {
+			// stands in for the source, so the other settings of the mount are still checked.
+			m.Source = "/"
+		}
+		if _, err := m.ToDocker(); err != nil {
+			return err
+		}
+		if !deferred && m.mountType() == mount.TypeBind && !c.IsHostPathAllowed(m.Source) {
+			return fmt.Errorf("host path %v is not in allowed-host-paths", m.Source)
+		}
+	}
+	return nil
+}
+
+// warnUnrestrictedHostPath logs a template binding a host path while allowed-host-paths is empty.
+func (c *Config) warnUnrestrictedHostPath(template *ContainerConfig, hostPath string) {
+	if len(c.AllowedHostPaths) == 0 {
+		log.Printf("template %v binds host path %v, which is unrestricted as allowed-host-paths is empty", template.Name, hostPath)
+	}
+}
+
+func hasVariable(s string) bool {
+	return strings.Contains(s, "${")
+}
+
+// IsHostPathAllowed reports whether path lies in one of the allowed-host-paths once symlinks are resolved,
+// so a link inside an allowed directory can't bind what it points to. An empty allowlist allows every path.
+func (c *Config) IsHostPathAllowed(path string) bool {
+	if len(c.AllowedHostPaths) == 0 {
+		return true
+	}
+	resolved, err := resolvePath(path)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range c.AllowedHostPaths {
+		if allowed, err = resolvePath(allowed); err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(allowed, resolved)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, "../") {
+			return true
+		}
+	}
+	return false
+}
+
+// resolvePath resolves the symlinks of an absolute path. Docker creates missing bind sources, so the part
+// that doesn't exist yet is appended as is to the resolved existing parent.
+func resolvePath(path string) (string, error) {
+	path = filepath.Clean(path)
+	resolved, err := filepath.EvalSymlinks(path)
+	if err == nil {
+		return resolved, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+	parent := filepath.Dir(path)
+	if parent == path {
+		return "", err
+	}
+	if resolved, err = resolvePath(parent); err != nil {
+		return "", err
+	}
+	return filepath.Join(resolved, filepath.Base(path)), nil
+}
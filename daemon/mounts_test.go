@@ -0,0 +1,93 @@
+package daemon
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/goccy/go-yaml"
+)
+
+func TestIsHostPathAllowed(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "ab", "outside"} {
+		if err := os.Mkdir(filepath.Join(dir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(dir, "outside"), filepath.Join(dir, "a", "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(dir, "a"), filepath.Join(dir, "alias")); err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{AllowedHostPaths: []string{filepath.Join(dir, "a")}}
+
+	tests := []struct {
+		name string
+		path string
+		want bool
+	}{
+		{"allowed directory", "/a", true},
+		{"file below", "/a/file", true},
+		{"missing directories below", "/a/x/y", true},
+		{"traversal", "/a/../outside", false},
+		{"traversal of a missing directory", "/a/missing/../../outside", false},
+		{"sibling prefix", "/ab", false},
+		{"sibling prefix below", "/ab/file", false},
+		{"parent", "/", false},
+		{"symlink out of the allowed directory", "/a/link", false},
+		{"below a symlink out of the allowed directory", "/a/link/file", false},
+		{"symlink to the allowed directory", "/alias/file", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := config.IsHostPathAllowed(dir + test.path); got != test.want {
+				t.Errorf("IsHostPathAllowed(%v) = %v, want %v", test.path, got, test.want)
+			}
+		})
+	}
+
+	if !(&Config{}).IsHostPathAllowed("/etc") {
+		t.Errorf("an empty allowlist should allow every path")
+	}
+}
+
+func TestMountConfigTmpfsMode(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		want    os.FileMode
+		wantErr bool
+	}{
+		{"unset", "target: /tmp", 0, false},
+		{"unquoted", "target: /tmp\ntmpfs-mode: 1777", 01777, false},
+		{"quoted", "target: /tmp\ntmpfs-mode: \"0700\"", 0700, false},
+		{"not octal", "target: /tmp\ntmpfs-mode: \"0789\"", 0, true},
+		{"too large", "target: /tmp\ntmpfs-mode: \"17777\"", 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var m MountConfig
+			if err := yaml.Unmarshal([]byte("type: tmpfs\n"+test.yaml), &m); err != nil {
+				t.Fatal(err)
+			}
+			result, err := m.ToDocker()
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("expected an error for tmpfs-mode %v", m.TmpfsMode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.TmpfsOptions.Mode != test.want {
+				t.Errorf("mode = %o, want %o", result.TmpfsOptions.Mode, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"time"
+
+	"github.com/docker/docker/client"
+)
+
+const defaultQuotaWarnAt = 0.9
+
+// QuotaConfig limits the disk usage of a workspace: its data directory, plus the container's writable layer if include-rootfs is set.
+type QuotaConfig struct {
+	Limit         string  `yaml:"limit"`   // e.g. "20g"
+	WarnAt        float64 `yaml:"warn-at"` // fraction of the limit, defaults to 0.9
+	IncludeRootfs bool    `yaml:"include-rootfs"`
+}
+
+// Quota is a QuotaConfig resolved for a user.
+type Quota struct {
+	Limit         int64
+	WarnAt        float64
+	IncludeRootfs bool
+}
+
+type DiskUsage struct {
+	Data    int64
+	Rootfs  int64
+	Scanned time.Time
+}
+
+func (u *DiskUsage) Total(quota *Quota) int64 {
+	if quota.IncludeRootfs {
+		return u.Data + u.Rootfs
+	}
+	return u.Data
+}
+
+func (q *QuotaConfig) validate() error {
+	if _, err := parseSize(q.Limit); err != nil {
+		return fmt.Errorf("invalid quota limit: %v", err)
+	}
+	if q.WarnAt < 0 || q.WarnAt > 1 {
+		return fmt.Errorf("quota warn-at must be between 0 and 1")
+	}
+	return nil
+}
+
+// QuotaOf resolves the quota of a user, where quota-overrides take precedence over the limit of the template.
+// It returns nil if the user has no quota.
+func (c *Config) QuotaOf(user string, template *ContainerConfig) *Quota {
+	quota := &Quota{WarnAt: defaultQuotaWarnAt}
+	if template.Quota != nil {
+		quota.Limit, _ = parseSize(template.Quota.Limit)
+		quota.IncludeRootfs = template.Quota.IncludeRootfs
+		if template.Quota.WarnAt != 0 {
+			quota.WarnAt = template.Quota.WarnAt
+		}
+	}
+	if override, ok := c.QuotaOverrides[user]; ok {
+		quota.Limit, _ = parseSize(override)
+	}
+	if quota.Limit <= 0 {
+		return nil
+	}
+	return quota
+}
+
+// DirSize sums the size of regular files under dir.
+func DirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// ContainerRootfsSize returns the size of the writable layer of a container.
+func ContainerRootfsSize(ctx context.Context, dockerClient *client.Client, containerId string) (int64, error) {
+	info, _, err := dockerClient.ContainerInspectWithRaw(ctx, containerId, true)
+	if err != nil {
+		return 0, err
+	}
+	if info.SizeRw == nil {
+		return 0, nil
+	}
+	return *info.SizeRw, nil
+}
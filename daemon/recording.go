@@ -0,0 +1,282 @@
+package daemon
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const recordingExt = ".cast"
+
+// RecordingConfig enables recording of terminal sessions in asciicast v2 format,
+// stored as <dir>/<workspace>/<timestamp>-<session>.cast.
+type RecordingConfig struct {
+	Dir    string        `yaml:"dir"`
+	Input  bool          `yaml:"input"`   // also record what users type, passwords included
+	MaxAge time.Duration `yaml:"max-age"` // recordings older than this are removed, zero keeps forever
+}
+
+func (c *RecordingConfig) validate() error {
+	if c.Dir == "" {
+		return fmt.Errorf("recording needs a dir")
+	}
+	if c.MaxAge < 0 {
+		return fmt.Errorf("recording max-age must not be negative")
+	}
+	return nil
+}
+
+type Recording struct {
+	Workspace string
+	Path      string
+	Modified  time.Time
+	Size      int64
+}
+
+// Recorder writes events of a terminal session to an asciicast v2 file. It's safe for concurrent use.
+type Recorder struct {
+	lock    sync.Mutex
+	file    *os.File
+	started time.Time
+	// pending holds the incomplete UTF-8 sequence at the end of the last write of each event type.
+	pending map[string][]byte
+}
+
+type asciicastHeader struct {
+	Version   int               `json:"version"`
+	Width     uint              `json:"width"`
+	Height    uint              `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// StartRecording creates a recording for a session of the workspace and applies the retention policy.
+func StartRecording(config *RecordingConfig, workspace string, session uint64, width uint, height uint, title string) (*Recorder, error) {
+	dir := filepath.Join(config.Dir, workspace)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create recording directory: %v", err)
+	}
+	if config.MaxAge > 0 {
+		if err := PruneRecordings(dir, config.MaxAge); err != nil {
+			log.Printf("Failed to prune recordings of %v: %v", workspace, err)
+		}
+	}
+	now := time.Now()
+	name := fmt.Sprintf("%v-%v%v", now.Format(snapshotTagLayout), session, recordingExt)
+	file, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create recording: %v", err)
+	}
+	if width == 0 || height == 0 {
+		width, height = 80, 24
+	}
+	header, _ := json.Marshal(asciicastHeader{
+		Version:   2,
+		Width:     width,
+		Height:    height,
+		Timestamp: now.Unix(),
+		Title:     title,
+	})
+	if _, err := file.Write(append(header, '\n')); err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("failed to write recording: %v", err)
+	}
+	return &Recorder{
+		file:    file,
+		started: now,
+		pending: make(map[string][]byte),
+	}, nil
+}
+
+func (r *Recorder) event(kind string, data string) {
+	line, _ := json.Marshal([]any{time.Since(r.started).Seconds(), kind, data})
+	if _, err := r.file.Write(append(line, '\n')); err != nil {
+		log.Printf("Failed to write recording, stopped: %v", err)
+		_ = r.file.Close()
+		r.file = nil
+	}
+}
+
+func (r *Recorder) record(kind string, p []byte) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.file == nil {
+		return
+	}
+	data := append(r.pending[kind], p...)
+	// JSON strings are UTF-8, so a character split between two writes is kept for the next one.
+	cut := len(data)
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				cut = i
+			}
+			break
+		}
+	}
+	r.pending[kind] = append([]byte(nil), data[cut:]...)
+	if cut > 0 {
+		r.event(kind, string(data[:cut]))
+	}
+}
+
+// Resize records a change of the terminal size.
+func (r *Recorder) Resize(width uint, height uint) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.file == nil {
+		return
+	}
+	r.event("r", fmt.Sprintf("%vx%v", width, height))
+}
+
+// Output returns a writer recording output of the session. Writes never fail.
+func (r *Recorder) Output() io.Writer {
+	return recorderWriter{r, "o"}
+}
+
+// Input returns a writer recording input of the session. Writes never fail.
+func (r *Recorder) Input() io.Writer {
+	return recorderWriter{r, "i"}
+}
+
+func (r *Recorder) Close() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.file == nil {
+		return
+	}
+	_ = r.file.Close()
+	r.file = nil
+}
+
+type recorderWriter struct {
+	recorder *Recorder
+	kind     string
+}
+
+func (w recorderWriter) Write(p []byte) (int, error) {
+	w.recorder.record(w.kind, p)
+	return len(p), nil
+}
+
+// PruneRecordings removes recordings in dir that weren't written to for maxAge.
+func PruneRecordings(dir string, maxAge time.Duration) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(-maxAge)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), recordingExt) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || !info.ModTime().Before(deadline) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListRecordings lists recordings under dir, of one workspace or of all if workspace is empty.
+func ListRecordings(dir string, workspace string) ([]Recording, error) {
+	pattern := filepath.Join(dir, "*", "*"+recordingExt)
+	if workspace != "" {
+		pattern = filepath.Join(dir, workspace, "*"+recordingExt)
+	}
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	recordings := make([]Recording, 0, len(paths))
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		recordings = append(recordings, Recording{
+			Workspace: filepath.Base(filepath.Dir(path)),
+			Path:      path,
+			Modified:  info.ModTime(),
+			Size:      info.Size(),
+		})
+	}
+	sort.Slice(recordings, func(i, j int) bool {
+		return recordings[i].Path < recordings[j].Path
+	})
+	return recordings, nil
+}
+
+// RecordingDirs returns the recording directories of all templates.
+func (c *Config) RecordingDirs() []string {
+	seen := make(map[string]bool)
+	var dirs []string
+	for _, template := range c.Templates {
+		if template.Recording == nil || seen[template.Recording.Dir] {
+			continue
+		}
+		seen[template.Recording.Dir] = true
+		dirs = append(dirs, template.Recording.Dir)
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+// ReplayRecording plays the output of a recording to w in real time, divided by speed.
+// Pauses are shortened to maxIdle if it's positive.
+func ReplayRecording(path string, w io.Writer, speed float64, maxIdle time.Duration) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	if !scanner.Scan() {
+		return fmt.Errorf("empty recording")
+	}
+	var header asciicastHeader
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil || header.Version != 2 {
+		return fmt.Errorf("not an asciicast v2 recording")
+	}
+	if speed <= 0 {
+		speed = 1
+	}
+	last := 0.0
+	for scanner.Scan() {
+		var event []any
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil || len(event) != 3 {
+			return fmt.Errorf("malformed event: %v", scanner.Text())
+		}
+		at, _ := event[0].(float64)
+		kind, _ := event[1].(string)
+		data, _ := event[2].(string)
+		if kind != "o" {
+			continue
+		}
+		delay := time.Duration((at - last) / speed * float64(time.Second))
+		if maxIdle > 0 && delay > maxIdle {
+			delay = maxIdle
+		}
+		time.Sleep(delay)
+		last = at
+		if _, err := io.WriteString(w, data); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
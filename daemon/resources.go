@@ -0,0 +1,148 @@
+package daemon
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types/blkiodev"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/go-units"
+)
+
+// ResourceConfig limits what a single workspace may consume on the host.
+// Sizes accept docker-style units like "512m" or "4g".
+type ResourceConfig struct {
+	Memory            string   `yaml:"memory"`
+	MemoryReservation string   `yaml:"memory-reservation"`
+	MemorySwap        string   `yaml:"memory-swap"` // "-1" for unlimited swap
+	CpuShares         int64    `yaml:"cpu-shares"`
+	Cpus              float64  `yaml:"cpus"`
+	CpuPeriod         int64    `yaml:"cpu-period"`
+	CpuQuota          int64    `yaml:"cpu-quota"`
+	CpusetCpus        string   `yaml:"cpuset-cpus"`
+	CpusetMems        string   `yaml:"cpuset-mems"`
+	PidsLimit         int64    `yaml:"pids-limit"`
+	BlkioWeight       uint16   `yaml:"blkio-weight"`
+	BlkioWeightDevice []string `yaml:"blkio-weight-device"` // <device>:<weight>
+	DeviceReadBps     []string `yaml:"device-read-bps"`     // <device>:<rate>
+	DeviceWriteBps    []string `yaml:"device-write-bps"`    // <device>:<rate>
+	DeviceReadIOps    []string `yaml:"device-read-iops"`    // <device>:<ops>
+	DeviceWriteIOps   []string `yaml:"device-write-iops"`   // <device>:<ops>
+	Ulimits           []string `yaml:"ulimits"`             // <type>=<soft>[:<hard>]
+}
+
+func (r *ResourceConfig) ToDocker() (container.Resources, error) {
+	var err error
+	resources := container.Resources{
+		CPUShares:   r.CpuShares,
+		CPUPeriod:   r.CpuPeriod,
+		CPUQuota:    r.CpuQuota,
+		CpusetCpus:  r.CpusetCpus,
+		CpusetMems:  r.CpusetMems,
+		BlkioWeight: r.BlkioWeight,
+	}
+	if r.Cpus != 0 {
+		if r.Cpus < 0 {
+			return resources, fmt.Errorf("cpus must be positive, got %v", r.Cpus)
+		}
+		if r.CpuPeriod != 0 || r.CpuQuota != 0 {
+			return resources, fmt.Errorf("cpus cannot be combined with cpu-period or cpu-quota")
+		}
+		resources.NanoCPUs = int64(r.Cpus * 1e9)
+	}
+	if r.PidsLimit != 0 {
+		limit := r.PidsLimit
+		resources.PidsLimit = &limit
+	}
+	if resources.Memory, err = parseSize(r.Memory); err != nil {
+		return resources, fmt.Errorf("invalid memory: %v", err)
+	}
+	if resources.MemoryReservation, err = parseSize(r.MemoryReservation); err != nil {
+		return resources, fmt.Errorf("invalid memory-reservation: %v", err)
+	}
+	if r.MemorySwap == "-1" {
+		resources.MemorySwap = -1
+	} else if resources.MemorySwap, err = parseSize(r.MemorySwap); err != nil {
+		return resources, fmt.Errorf("invalid memory-swap: %v", err)
+	}
+	if resources.MemorySwap != 0 {
+		// checked here since Docker only refuses these when the container is created.
+		if resources.Memory == 0 {
+			return resources, fmt.Errorf("memory-swap needs memory to be set")
+		}
+		if resources.MemorySwap > 0 && resources.MemorySwap < resources.Memory {
+			return resources, fmt.Errorf("memory-swap %v must not be smaller than memory %v", r.MemorySwap, r.Memory)
+		}
+	}
+	for _, entry := range r.BlkioWeightDevice {
+		path, value, err := splitDeviceEntry(entry)
+		if err != nil {
+			return resources, fmt.Errorf("invalid blkio-weight-device: %v", err)
+		}
+		weight, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return resources, fmt.Errorf("invalid blkio-weight-device %v: %v", entry, err)
+		}
+		resources.BlkioWeightDevice = append(resources.BlkioWeightDevice, &blkiodev.WeightDevice{Path: path, Weight: uint16(weight)})
+	}
+	if resources.BlkioDeviceReadBps, err = parseThrottleDevices(r.DeviceReadBps, true); err != nil {
+		return resources, fmt.Errorf("invalid device-read-bps: %v", err)
+	}
+	if resources.BlkioDeviceWriteBps, err = parseThrottleDevices(r.DeviceWriteBps, true); err != nil {
+		return resources, fmt.Errorf("invalid device-write-bps: %v", err)
+	}
+	if resources.BlkioDeviceReadIOps, err = parseThrottleDevices(r.DeviceReadIOps, false); err != nil {
+		return resources, fmt.Errorf("invalid device-read-iops: %v", err)
+	}
+	if resources.BlkioDeviceWriteIOps, err = parseThrottleDevices(r.DeviceWriteIOps, false); err != nil {
+		return resources, fmt.Errorf("invalid device-write-iops: %v", err)
+	}
+	for _, entry := range r.Ulimits {
+		ulimit, err := units.ParseUlimit(entry)
+		if err != nil {
+			return resources, err
+		}
+		resources.Ulimits = append(resources.Ulimits, ulimit)
+	}
+	return resources, nil
+}
+
+func parseSize(size string) (int64, error) {
+	if size == "" {
+		return 0, nil
+	}
+	return units.RAMInBytes(size)
+}
+
+func splitDeviceEntry(entry string) (path string, value string, err error) {
+	index := strings.LastIndex(entry, ":")
+	if index <= 0 || index == len(entry)-1 {
+		return "", "", fmt.Errorf("%v is not in <device>:<value> form", entry)
+	}
+	if !strings.HasPrefix(entry, "/dev/") {
+		return "", "", fmt.Errorf("%v is not a device path", entry)
+	}
+	return entry[:index], entry[index+1:], nil
+}
+
+func parseThrottleDevices(entries []string, isSize bool) ([]*blkiodev.ThrottleDevice, error) {
+	var devices []*blkiodev.ThrottleDevice
+	for _, entry := range entries {
+		path, value, err := splitDeviceEntry(entry)
+		if err != nil {
+			return nil, err
+		}
+		var rate int64
+		if isSize {
+			rate, err = units.RAMInBytes(value)
+		} else {
+			rate, err = strconv.ParseInt(value, 10, 64)
+		}
+		if err != nil || rate < 0 {
+			return nil, fmt.Errorf("invalid rate in %v", entry)
+		}
+		devices = append(devices, &blkiodev.ThrottleDevice{Path: path, Rate: uint64(rate)})
+	}
+	return devices, nil
+}
@@ -0,0 +1,64 @@
+package daemon
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestResourceConfigToDocker(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  ResourceConfig
+		wantErr string
+	}{
+		{name: "empty", config: ResourceConfig{}},
+		{name: "cpus", config: ResourceConfig{Cpus: 1.5}},
+		{name: "cpu quota and period", config: ResourceConfig{CpuPeriod: 100000, CpuQuota: 50000}},
+		{name: "negative cpus", config: ResourceConfig{Cpus: -1}, wantErr: "cpus must be positive"},
+		{name: "cpus with quota", config: ResourceConfig{Cpus: 1, CpuQuota: 50000}, wantErr: "cannot be combined"},
+		{name: "cpus with period", config: ResourceConfig{Cpus: 1, CpuPeriod: 100000}, wantErr: "cannot be combined"},
+		{name: "memory", config: ResourceConfig{Memory: "512m", MemoryReservation: "256m"}},
+		{name: "invalid memory", config: ResourceConfig{Memory: "lots"}, wantErr: "invalid memory"},
+		{name: "swap larger than memory", config: ResourceConfig{Memory: "1g", MemorySwap: "2g"}},
+		{name: "swap equal to memory", config: ResourceConfig{Memory: "1g", MemorySwap: "1g"}},
+		{name: "unlimited swap", config: ResourceConfig{Memory: "1g", MemorySwap: "-1"}},
+		{name: "swap smaller than memory", config: ResourceConfig{Memory: "1g", MemorySwap: "512m"}, wantErr: "must not be smaller"},
+		{name: "swap without memory", config: ResourceConfig{MemorySwap: "1g"}, wantErr: "needs memory"},
+		{name: "device rate", config: ResourceConfig{DeviceReadBps: []string{"/dev/sda:10mb"}}},
+		{name: "device not under /dev", config: ResourceConfig{DeviceReadBps: []string{"sda:10mb"}}, wantErr: "not a device path"},
+		{name: "blkio weight device", config: ResourceConfig{BlkioWeightDevice: []string{"/dev/sda:200"}}},
+		{name: "invalid blkio weight", config: ResourceConfig{BlkioWeightDevice: []string{"/dev/sda:heavy"}}, wantErr: "invalid blkio-weight-device"},
+		{name: "ulimit", config: ResourceConfig{Ulimits: []string{"nofile=1024:2048"}}},
+		{name: "invalid ulimit", config: ResourceConfig{Ulimits: []string{"nofile"}}, wantErr: "ulimit"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := test.config.ToDocker()
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("got error %v, want one containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestResourceConfigToDockerValues(t *testing.T) {
+	resources, err := (&ResourceConfig{Cpus: 1.5, Memory: "1g", MemorySwap: "-1", PidsLimit: 100}).ToDocker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resources.NanoCPUs != 1500000000 {
+		t.Errorf("NanoCPUs = %v", resources.NanoCPUs)
+	}
+	if resources.Memory != 1<<30 || resources.MemorySwap != -1 {
+		t.Errorf("Memory = %v, MemorySwap = %v", resources.Memory, resources.MemorySwap)
+	}
+	if resources.PidsLimit == nil || *resources.PidsLimit != 100 {
+		t.Errorf("PidsLimit = %v", resources.PidsLimit)
+	}
+}
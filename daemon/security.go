@@ -0,0 +1,62 @@
+package daemon
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// SecurityConfig hardens a workspace without resorting to a privileged container.
+type SecurityConfig struct {
+	CapAdd          []string          `yaml:"cap-add"`
+	CapDrop         []string          `yaml:"cap-drop"`
+	SecurityOpt     []string          `yaml:"security-opt"`
+	NoNewPrivileges bool              `yaml:"no-new-privileges"`
+	ReadOnly        bool              `yaml:"read-only"`
+	Tmpfs           map[string]string `yaml:"tmpfs"`       // target -> mount options, like "rw,size=64m"
+	UsernsMode      string            `yaml:"userns-mode"` // "host" opts out of daemon-wide user namespace remapping
+
+	resolvedOpts []string
+}
+
+// resolve loads seccomp profiles referenced by path, since the engine API expects the profile content inline.
+func (s *SecurityConfig) resolve() error {
+	s.resolvedOpts = make([]string, 0, len(s.SecurityOpt)+1)
+	for _, opt := range s.SecurityOpt {
+		key, value, found := strings.Cut(opt, "=")
+		if !found {
+			key, value, found = strings.Cut(opt, ":")
+		}
+		if !found {
+			if opt != "no-new-privileges" {
+				return fmt.Errorf("invalid security-opt %v", opt)
+			}
+		} else if key == "seccomp" && value != "unconfined" && value != "builtin" {
+			profile, err := os.ReadFile(value)
+			if err != nil {
+				return fmt.Errorf("failed to read seccomp profile: %v", err)
+			}
+			compacted := &bytes.Buffer{}
+			if err := json.Compact(compacted, profile); err != nil {
+				return fmt.Errorf("invalid seccomp profile %v: %v", value, err)
+			}
+			opt = "seccomp=" + compacted.String()
+		}
+		s.resolvedOpts = append(s.resolvedOpts, opt)
+	}
+	if s.NoNewPrivileges {
+		s.resolvedOpts = append(s.resolvedOpts, "no-new-privileges:true")
+	}
+	return nil
+}
+
+func (s *SecurityConfig) securityOpts() ([]string, error) {
+	if s.resolvedOpts == nil {
+		if err := s.resolve(); err != nil {
+			return nil, err
+		}
+	}
+	return s.resolvedOpts, nil
+}
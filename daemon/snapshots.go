@@ -0,0 +1,150 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+)
+
+const snapshotTagLayout = "20060102-150405"
+
+// SnapshotConfig is the retention policy of workspace snapshots, applied after each new snapshot.
+type SnapshotConfig struct {
+	Keep   int           `yaml:"keep"`    // snapshots kept per user, zero keeps all
+	MaxAge time.Duration `yaml:"max-age"` // zero keeps forever
+}
+
+type Snapshot struct {
+	Tag     string
+	ImageId string
+	Created time.Time
+	Size    int64
+}
+
+// SnapshotRepository is the image repository holding snapshots of a user, bubble-snapshot/<user>.
+// User names are normalized at authentication, so they are used as is and never shared between users.
+func SnapshotRepository(user string) string {
+	return "bubble-snapshot/" + user
+}
+
+// NewImportRef names an image imported by a user, bubble-import/<user>:<timestamp>.
+func NewImportRef(user string) string {
+	return "bubble-import/" + user + ":" + time.Now().Format(snapshotTagLayout)
+}
+
+// CreateSnapshot commits the container to SnapshotRepository(user):<timestamp> and applies the retention policy.
+func CreateSnapshot(ctx context.Context, dockerClient *client.Client, containerId string, user string, retention SnapshotConfig) (string, error) {
+	tag := SnapshotRepository(user) + ":" + time.Now().Format(snapshotTagLayout)
+	_, err := dockerClient.ContainerCommit(ctx, containerId, container.CommitOptions{
+		Reference: tag,
+		Comment:   "bubble snapshot of " + user,
+		Pause:     true,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to commit container: %v", err)
+	}
+	if err := PruneSnapshots(ctx, dockerClient, user, retention); err != nil {
+		log.Printf("Failed to prune snapshots of %v: %v", user, err)
+	}
+	return tag, nil
+}
+
+// ListSnapshots lists snapshots of a user, newest first.
+func ListSnapshots(ctx context.Context, dockerClient *client.Client, user string) ([]Snapshot, error) {
+	repository := SnapshotRepository(user)
+	images, err := dockerClient.ImageList(ctx, image.ListOptions{
+		Filters: filters.NewArgs(filters.Arg("reference", repository+":*")),
+	})
+	if err != nil {
+		return nil, err
+	}
+	snapshots := make([]Snapshot, 0, len(images))
+	for _, summary := range images {
+		for _, tag := range summary.RepoTags {
+			if !strings.HasPrefix(tag, repository+":") {
+				continue
+			}
+			snapshots = append(snapshots, Snapshot{
+				Tag:     tag,
+				ImageId: summary.ID,
+				Created: time.Unix(summary.Created, 0),
+				Size:    summary.Size,
+			})
+		}
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Tag > snapshots[j].Tag
+	})
+	return snapshots, nil
+}
+
+// IsSnapshotOf tells whether tag is one of the snapshots of the user.
+func IsSnapshotOf(tag string, user string) bool {
+	return strings.HasPrefix(tag, SnapshotRepository(user)+":")
+}
+
+func PruneSnapshots(ctx context.Context, dockerClient *client.Client, user string, retention SnapshotConfig) error {
+	if retention.Keep <= 0 && retention.MaxAge <= 0 {
+		return nil
+	}
+	snapshots, err := ListSnapshots(ctx, dockerClient, user)
+	if err != nil {
+		return err
+	}
+	for i, snapshot := range snapshots {
+		expired := retention.MaxAge > 0 && time.Since(snapshot.Created) > retention.MaxAge
+		if (retention.Keep > 0 && i >= retention.Keep) || expired {
+			log.Printf("Removing snapshot %v", snapshot.Tag)
+			_, err := dockerClient.ImageRemove(ctx, snapshot.Tag, image.RemoveOptions{PruneChildren: true})
+			if err != nil {
+				log.Printf("Failed to remove snapshot %v: %v", snapshot.Tag, err)
+			}
+		}
+	}
+	return nil
+}
+
+// ImportImage creates an image from a container filesystem exported by `docker export`. Since such
+// an archive carries no image config, cmd, entrypoint, env, workdir and user are taken from baseImage if it is present.
+func ImportImage(ctx context.Context, dockerClient *client.Client, source io.Reader, ref string, baseImage string) error {
+	changes := make([]string, 0)
+	if base, err := dockerClient.ImageInspect(ctx, baseImage); err == nil && base.Config != nil {
+		config := base.Config
+		if len(config.Entrypoint) > 0 {
+			entrypoint, _ := json.Marshal(config.Entrypoint)
+			changes = append(changes, "ENTRYPOINT "+string(entrypoint))
+		}
+		if len(config.Cmd) > 0 {
+			cmd, _ := json.Marshal(config.Cmd)
+			changes = append(changes, "CMD "+string(cmd))
+		}
+		for _, env := range config.Env {
+			changes = append(changes, "ENV "+env)
+		}
+		if config.WorkingDir != "" {
+			changes = append(changes, "WORKDIR "+config.WorkingDir)
+		}
+		if config.User != "" {
+			changes = append(changes, "USER "+config.User)
+		}
+	}
+	resp, err := dockerClient.ImageImport(ctx, image.ImportSource{Source: source, SourceName: "-"}, ref, image.ImportOptions{
+		Message: "bubble import",
+		Changes: changes,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to import image: %v", err)
+	}
+	defer resp.Close()
+	return renderBuildOutput(resp, func(string) {})
+}
@@ -0,0 +1,182 @@
+package sshd
+
+import (
+	"bubble/daemon"
+	"bubble/daemon/admin"
+	"bubble/daemon/audit"
+	"bubble/daemon/manager"
+	"context"
+	"fmt"
+	"log"
+	"sort"
+)
+
+// Sessions implements admin.Backend.
+func (sctx *SshServerContext) Sessions() []admin.SessionInfo {
+	sessions := make([]admin.SessionInfo, 0)
+	for _, conn := range sctx.Workspaces.AllSessions() {
+		sessions = append(sessions, admin.SessionInfo{
+			Id:          conn.SessionId,
+			User:        conn.User,
+			Key:         conn.KeyName,
+			Remote:      conn.Remote,
+			Workspace:   conn.Workspace,
+			Container:   conn.ContainerId,
+			Interactive: conn.Interactive,
+			Connected:   conn.Connected,
+		})
+	}
+	return sessions
+}
+
+// Containers implements admin.Backend.
+func (sctx *SshServerContext) Containers(ctx context.Context) ([]admin.ContainerInfo, error) {
+	list, err := daemon.ListWorkspaceContainers(ctx, sctx.DockerClient)
+	if err != nil {
+		return nil, err
+	}
+	containers := make([]admin.ContainerInfo, 0, len(list))
+	for _, c := range list {
+		containers = append(containers, admin.ContainerInfo{
+			Id:       c.ID,
+			Name:     c.Labels[daemon.LabelWorkspace],
+			User:     c.Labels[daemon.LabelUser],
+			Template: c.Labels[daemon.LabelTemplate],
+			State:    c.State,
+			Status:   c.Status,
+			Sessions: len(sctx.Workspaces.Sessions(c.ID)),
+		})
+	}
+	sort.Slice(containers, func(i, j int) bool {
+		return containers[i].Name < containers[j].Name
+	})
+	return containers, nil
+}
+
+// Forwards implements admin.Backend.
+func (sctx *SshServerContext) Forwards() []admin.ForwardInfo {
+	forwards := make([]admin.ForwardInfo, 0)
+	if sctx.manager == nil {
+		return forwards
+	}
+	for _, forward := range sctx.manager.Forwards() {
+		forwards = append(forwards, admin.ForwardInfo{
+			Container:     forward.ContainerId(),
+			HostPort:      forward.HostPort,
+			ContainerPort: forward.ContainerPort,
+			PublicAddress: forward.PublicAddress,
+		})
+	}
+	return forwards
+}
+
+// Kick implements admin.Backend. It closes the connection of a session.
+func (sctx *SshServerContext) Kick(id uint64) error {
+	for _, conn := range sctx.Workspaces.AllSessions() {
+		if conn.SessionId != id {
+			continue
+		}
+		log.Printf("(admin) Kicking session #%v of %v", id, conn.User)
+		conn.audit(audit.Record{Type: audit.Admin, Action: "kick"})
+		conn.PrintTextLn("\r\n[bubble] You have been disconnected by an administrator.")
+		conn.closeHandle()
+		return nil
+	}
+	return fmt.Errorf("session #%v: %w", id, admin.ErrNotFound)
+}
+
+// StopWorkspace implements admin.Backend.
+func (sctx *SshServerContext) StopWorkspace(name string) error {
+	containerId, workspace, err := sctx.findWorkspace(name)
+	if err != nil {
+		return err
+	}
+	log.Printf("(admin) Stopping %v", workspace)
+	daemon.RunPreStopHooks(sctx.context, sctx.DockerClient, sctx.AppConfig.Load(), containerId)
+	err = daemon.StopContainer(sctx.context, sctx.DockerClient, containerId)
+	sctx.recordAdmin(workspace, containerId, "stop", err)
+	return err
+}
+
+// DestroyWorkspace implements admin.Backend. Sessions of the workspace are closed.
+func (sctx *SshServerContext) DestroyWorkspace(name string) error {
+	containerId, workspace, err := sctx.findWorkspace(name)
+	if err != nil {
+		return err
+	}
+	log.Printf("(admin) Destroying %v", workspace)
+	sessions := sctx.Workspaces.Sessions(containerId)
+	for _, conn := range sessions {
+		conn.PrintTextLn("\r\n[bubble] This workspace is being destroyed by an administrator.")
+	}
+	daemon.RunPreStopHooks(sctx.context, sctx.DockerClient, sctx.AppConfig.Load(), containerId)
+	err = daemon.DestroyContainer(sctx.context, sctx.DockerClient, containerId)
+	sctx.recordAdmin(workspace, containerId, "destroy", err)
+	if err != nil {
+		return err
+	}
+	for _, conn := range sessions {
+		conn.closeHandle()
+	}
+	sctx.Workspaces.forget(containerId)
+	sctx.EventBus.Publish(manager.ManagerContainerRemovedEvent, manager.NewContainerRemovedEvent(containerId))
+	return nil
+}
+
+// findWorkspace finds a container created by bubble by its workspace name, or by the user it belongs to.
+func (sctx *SshServerContext) findWorkspace(name string) (containerId string, workspace string, err error) {
+	list, err := daemon.ListWorkspaceContainers(sctx.context, sctx.DockerClient)
+	if err != nil {
+		return "", "", err
+	}
+	for _, candidate := range []string{name, daemon.WorkspaceName(name)} {
+		for _, c := range list {
+			if c.Labels[daemon.LabelWorkspace] == candidate {
+				return c.ID, candidate, nil
+			}
+		}
+	}
+	return "", "", fmt.Errorf("workspace %v: %w", name, admin.ErrNotFound)
+}
+
+func (sctx *SshServerContext) recordAdmin(workspace string, containerId string, action string, err error) {
+	record := audit.Record{
+		Type:      audit.Admin,
+		Workspace: workspace,
+		Container: containerId,
+		Action:    action,
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	sctx.Audit.Record(record)
+}
+
+// Reload implements admin.Backend. Keys, access control and templates apply to new connections,
+// while listeners, the network and the audit log keep their settings until a restart.
+func (sctx *SshServerContext) Reload() error {
+	sctx.reloadLock.Lock()
+	defer sctx.reloadLock.Unlock()
+	config, err := daemon.LoadConfig(&sctx.ConfigPath)
+	if err != nil {
+		sctx.recordAdmin("", "", "reload", err)
+		return err
+	}
+	current := sctx.AppConfig.Load()
+	if config.Address != current.Address || config.Network != current.Network || config.ServerKey != current.ServerKey ||
+		config.Manager != current.Manager || config.Audit != current.Audit || config.Admin != current.Admin {
+		log.Printf("(admin) address, network-group, server-key-file, manager, audit and admin need a restart to change")
+	}
+	config.Address = current.Address
+	config.Network = current.Network
+	config.ServerKey = current.ServerKey
+	config.Manager = current.Manager
+	config.Audit = current.Audit
+	config.Admin = current.Admin
+	// operations in progress keep the config they loaded, later ones see the new one.
+	sctx.AppConfig.Store(config)
+	sctx.serverConfig.Store(setupSSHConfig(sctx.privateKey, config))
+	sctx.recordAdmin("", "", "reload", nil)
+	log.Printf("(admin) Reloaded config from %v", sctx.ConfigPath)
+	return nil
+}
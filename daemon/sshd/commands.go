@@ -0,0 +1,57 @@
+package sshd
+
+import (
+	"bubble/daemon/audit"
+	"fmt"
+	"io"
+	"log"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// builtinCommand runs inside bubble instead of the container when requested by exec, e.g. `ssh user@bubble bubble-snapshot`.
+// It returns the exit status sent to the client.
+type builtinCommand func(connCtx *SshConnContext, args []string, stdout io.Writer, stderr io.Writer) int
+
+var builtinCommands map[string]builtinCommand
+
+func init() {
+	builtinCommands = map[string]builtinCommand{
+		"bubble-snapshot": snapshotCommand,
+		"bubble-export":   exportCommand,
+		"bubble-import":   importCommand,
+		"bubble-join":     joinCommand,
+		"bubble-share":    shareCommand,
+		"bubble-sessions": sessionsCommand,
+		"bubble-observe":  observeCommand,
+	}
+}
+
+// runBuiltinCommand handles the exec request if it names a builtin command. The session ends when the command returns.
+func (connCtx *SshConnContext) runBuiltinCommand(req *ssh.Request, cmd []string) bool {
+	command, ok := builtinCommands[cmd[0]]
+	if !ok {
+		return false
+	}
+	_ = req.Reply(true, nil)
+	log.Printf("(%v) Running builtin command %v", connCtx.User, cmd)
+	connCtx.audit(audit.Record{Type: audit.Exec, Command: cmd})
+	go func() {
+		channel := *connCtx.Conn
+		status := command(connCtx, cmd[1:], channel, channel.Stderr())
+		_ = channel.CloseWrite()
+		_, _ = channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+		_ = channel.Close()
+		connCtx.closeHandle()
+	}()
+	return true
+}
+
+// println writes a line ending that also works when the client allocated a pty.
+func (connCtx *SshConnContext) println(w io.Writer, format string, args ...any) {
+	ending := "\n"
+	if connCtx.Interactive {
+		ending = "\r\n"
+	}
+	_, _ = fmt.Fprintf(w, format+ending, args...)
+}
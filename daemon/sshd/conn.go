@@ -1,10 +1,17 @@
 package sshd
 
 import (
+	"bubble/daemon"
+	"bubble/daemon/audit"
 	"context"
 	"fmt"
 	"io"
 	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/docker/docker/api/types/container"
 	"github.com/werbenhu/eventbus"
@@ -16,16 +23,40 @@ type SshConnContext struct {
 	EventBus      *eventbus.EventBus
 	context       context.Context
 	User          string
+	KeyName       string
+	Fingerprint   string
+	Remote        string
 	Conn          *ssh.Channel
 	Interactive   bool
+	// Workspace, ContainerId and Template are set once the container is prepared.
+	Workspace   string
+	ContainerId string
+	Template    *daemon.ContainerConfig
+	Vars        *daemon.TemplateVars
+	SessionId   uint64
+	Connected   time.Time
+	pty         atomic.Pointer[PtySession]
+	closeHandle func()
+	// outputLock serializes writes to the terminal, so that notices land between chunks of container output.
+	outputLock sync.Mutex
+	// notices queues messages to the session, see queueNotice.
+	notices      chan string
+	noticeLock   sync.Mutex
+	noticeWriter bool
 }
 
+// RedirectToContainer starts cmd in the container and pipes it to the session.
 func (connCtx *SshConnContext) RedirectToContainer(
 	containerID string,
 	cmd []string,
-) (closeHandle func(), execId *string, err error) {
-	env := make([]string, 0)
-	//todo more env
+	user string,
+) (stream *ptyStream, err error) {
+	// tag the exec with who opened it.
+	env := []string{
+		"BUBBLE_USER=" + connCtx.User,
+		"BUBBLE_KEY=" + connCtx.KeyName,
+		"BUBBLE_SESSION=" + strconv.FormatUint(connCtx.SessionId, 10),
+	}
 	execConfig := container.ExecOptions{
 		Tty:          connCtx.Interactive,
 		AttachStdin:  true,
@@ -33,34 +64,61 @@ func (connCtx *SshConnContext) RedirectToContainer(
 		AttachStderr: true,
 		Cmd:          cmd,
 		Env:          env,
+		User:         user,
 	}
 	sctx := connCtx.ServerContext
 	dockerClient := sctx.DockerClient
 	execResp, err := dockerClient.ContainerExecCreate(sctx.context, containerID, execConfig)
 	if err != nil {
-		return nil, nil, fmt.Errorf("error occurred while exec-ing! %v\n", err)
+		return nil, fmt.Errorf("error occurred while exec-ing! %v\n", err)
 	}
 	id := execResp.ID
 
 	hijackedResp, err := dockerClient.ContainerExecAttach(sctx.context, id, container.ExecStartOptions{Tty: true})
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to attach instance! %v\n", err)
+		return nil, fmt.Errorf("failed to attach instance! %v\n", err)
+	}
+	stream = newPtyStream(connCtx, id, hijackedResp.Conn, hijackedResp.Close, connCtx.startRecording(cmd))
+	output := io.MultiWriter(connCtx.terminal(), stream)
+	if stream.recorder != nil {
+		output = io.MultiWriter(output, stream.recorder.Output())
 	}
 
 	// these io.Copy are expected to close at the same time.
 	conn := connCtx.Conn
+	touch := func() {
+		sctx.Workspaces.Touch(containerID)
+	}
 	go func() {
-		_, _ = io.Copy(hijackedResp.Conn, *conn)
+		_, _ = io.Copy(stream.input, &activityReader{reader: *conn, activity: touch})
 		_ = hijackedResp.CloseWrite()
 	}()
 	go func() {
-		_, _ = io.Copy(*conn, hijackedResp.Reader)
+		// output counts too, so builds or a tail -f keep the workspace alive while someone is attached.
+		_, _ = io.Copy(output, &activityReader{reader: hijackedResp.Reader, activity: touch})
+		stream.finish()
 		connCtx.EventBus.Publish(ClientPipeBrokenEvent, NewBrokenPipeEvent(id))
-		(*connCtx.Conn).Close()
 	}()
-	return func() {
-		hijackedResp.Close()
-	}, &id, nil
+	return stream, nil
+}
+
+// startRecording starts recording a terminal session if the template asks for it. It's called with the pty lock held.
+func (connCtx *SshConnContext) startRecording(cmd []string) *daemon.Recorder {
+	config := connCtx.Template.Recording
+	if config == nil || !connCtx.Interactive {
+		return nil
+	}
+	var width, height uint
+	if pty := connCtx.pty.Load(); pty != nil && pty.size != nil {
+		width, height = decodeWindowSize(pty.size)
+	}
+	title := fmt.Sprintf("%v@%v: %v", connCtx.displayName(), connCtx.Workspace, strings.Join(cmd, " "))
+	recorder, err := daemon.StartRecording(config, connCtx.Workspace, connCtx.SessionId, width, height, title)
+	if err != nil {
+		log.Printf("(%v) Failed to start recording: %v", connCtx.User, err)
+		return nil
+	}
+	return recorder
 }
 
 func (connCtx *SshConnContext) logToBoth(msg string) {
@@ -68,8 +126,71 @@ func (connCtx *SshConnContext) logToBoth(msg string) {
 	log.Println(msg)
 }
 
+// PrintTextLn writes to the terminal of an interactive session. Before a pty is requested, or for
+// non-interactive sessions, text goes to stderr so it can't corrupt the stdout of exec and sftp.
 func (connCtx *SshConnContext) PrintTextLn(text string) {
+	connCtx.writeText(text + "\r\n")
+}
+
+func (connCtx *SshConnContext) writeText(text string) {
 	if connCtx.Interactive {
-		_, _ = (*connCtx.Conn).Write([]byte(text + "\r\n"))
+		_, _ = connCtx.terminal().Write([]byte(text))
+	} else {
+		_, _ = (*connCtx.Conn).Stderr().Write([]byte(text))
+	}
+}
+
+// terminal is the output of the session, shared by the container and bubble.
+func (connCtx *SshConnContext) terminal() io.Writer {
+	return &lockedWriter{lock: &connCtx.outputLock, writer: *connCtx.Conn}
+}
+
+type lockedWriter struct {
+	lock   *sync.Mutex
+	writer io.Writer
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.writer.Write(p)
+}
+
+// activityReportInterval limits how often a busy stream reports activity of the workspace.
+const activityReportInterval = time.Second
+
+// activityReader reports successful reads as activity of the workspace, at most once per activityReportInterval.
+type activityReader struct {
+	reader     io.Reader
+	activity   func()
+	lastReport time.Time
+}
+
+func (r *activityReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 && time.Since(r.lastReport) >= activityReportInterval {
+		r.lastReport = time.Now()
+		r.activity()
+	}
+	return n, err
+}
+
+// audit records an event of the session, filling in who and where.
+func (connCtx *SshConnContext) audit(record audit.Record) {
+	record.User = connCtx.User
+	record.Key = connCtx.KeyName
+	record.Fingerprint = connCtx.Fingerprint
+	record.Remote = connCtx.Remote
+	record.Session = connCtx.SessionId
+	record.Workspace = connCtx.Workspace
+	record.Container = connCtx.ContainerId
+	connCtx.ServerContext.Audit.Record(record)
+}
+
+// displayName names the person behind a session, which is the key name if there is one.
+func (connCtx *SshConnContext) displayName() string {
+	if connCtx.KeyName != "" {
+		return fmt.Sprintf("%v (#%v)", connCtx.KeyName, connCtx.SessionId)
 	}
+	return fmt.Sprintf("%v (#%v)", connCtx.User, connCtx.SessionId)
 }
@@ -13,6 +13,7 @@ const (
 
 	ConnectionCloseEvent       = "ConnectionCloseEvent"
 	ConnectionEstablishedEvent = "ConnectionEstablishedEvent"
+	SessionAttachedEvent       = "SessionAttachedEvent"
 )
 
 func NewConnectionEstablishedEvent(conn *SshConnContext) *daemon.ServerEvent {
@@ -23,6 +24,11 @@ func NewConnectionLostEvent(conn *SshConnContext) *daemon.ServerEvent {
 	return daemon.CreateEventRaw(ConnectionCloseEvent, 0, conn)
 }
 
+// NewSessionAttachedEvent is published once the container of a connection is ready.
+func NewSessionAttachedEvent(conn *SshConnContext) *daemon.ServerEvent {
+	return daemon.CreateEventRaw(SessionAttachedEvent, 0, conn)
+}
+
 func ConnectionEvent(c *daemon.ServerEvent) *SshConnContext {
 	return c.DataRaw().(*SshConnContext)
 }
@@ -59,8 +65,15 @@ func NewResizeEvent(dims []byte) *daemon.ServerEvent {
 	return daemon.CreateEventRaw(ClientResizeEvent, 0, dims)
 }
 
-// algo taken from https://gist.github.com/jpillora/b480fde82bff51a06238.
 func ResizeEvent(c *daemon.ServerEvent) (w uint, h uint) {
-	data := c.DataRaw().([]byte)
+	return decodeWindowSize(ResizeEventData(c))
+}
+
+func ResizeEventData(c *daemon.ServerEvent) []byte {
+	return c.DataRaw().([]byte)
+}
+
+// algo taken from https://gist.github.com/jpillora/b480fde82bff51a06238.
+func decodeWindowSize(data []byte) (w uint, h uint) {
 	return uint(binary.BigEndian.Uint32(data)), uint(binary.BigEndian.Uint32(data[4:]))
 }
@@ -0,0 +1,101 @@
+package sshd
+
+import (
+	"bubble/daemon"
+	"io"
+	"log"
+	"os"
+	"syscall"
+)
+
+// exportCommand streams the workspace directory, or the container filesystem with --rootfs, as a tar archive to stdout.
+func exportCommand(connCtx *SshConnContext, args []string, stdout io.Writer, stderr io.Writer) int {
+	sctx := connCtx.ServerContext
+	rootfs, ok := parseRootfsFlag(args)
+	if !ok {
+		connCtx.println(stderr, "Usage: bubble-export [--rootfs] > workspace.tar")
+		return 2
+	}
+	if rootfs {
+		stream, err := sctx.DockerClient.ContainerExport(sctx.context, connCtx.ContainerId)
+		if err != nil {
+			connCtx.println(stderr, "Failed to export container: %v", err)
+			return 1
+		}
+		defer stream.Close()
+		if _, err := io.Copy(stdout, stream); err != nil {
+			log.Printf("(%v) Export of container filesystem interrupted: %v", connCtx.User, err)
+			return 1
+		}
+		return 0
+	}
+	if connCtx.Vars.WorkspaceDir == "" {
+		connCtx.println(stderr, "This workspace has no data directory, try --rootfs.")
+		return 1
+	}
+	if err := daemon.WriteDirTar(connCtx.Vars.WorkspaceDir, stdout); err != nil {
+		log.Printf("(%v) Export of workspace data interrupted: %v", connCtx.User, err)
+		connCtx.println(stderr, "Failed to export workspace data: %v", err)
+		return 1
+	}
+	return 0
+}
+
+// importCommand restores an archive made by bubble-export from stdin. Workspace data is merged into the
+// data directory, while a container filesystem replaces the workspace container.
+func importCommand(connCtx *SshConnContext, args []string, stdout io.Writer, stderr io.Writer) int {
+	sctx := connCtx.ServerContext
+	rootfs, ok := parseRootfsFlag(args)
+	if !ok {
+		connCtx.println(stderr, "Usage: bubble-import [--rootfs] < workspace.tar")
+		return 2
+	}
+	stdin := *connCtx.Conn
+	if rootfs {
+		ref := daemon.NewImportRef(connCtx.User)
+		connCtx.println(stderr, "Importing container filesystem as %v...", ref)
+		if err := daemon.ImportImage(sctx.context, sctx.DockerClient, stdin, ref, connCtx.Template.Image); err != nil {
+			connCtx.println(stderr, "%v", err)
+			return 1
+		}
+		err := sctx.recreateWorkspace(connCtx.User, connCtx.KeyName, ref, func(line string) {
+			connCtx.println(stderr, "%v", line)
+		})
+		if err != nil {
+			connCtx.println(stderr, "Failed to recreate workspace: %v", err)
+			return 1
+		}
+		log.Printf("(%v) Imported workspace from %v", connCtx.User, ref)
+		return 0
+	}
+	dir := connCtx.Vars.WorkspaceDir
+	if dir == "" {
+		connCtx.println(stderr, "This workspace has no data directory, try --rootfs.")
+		return 1
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		connCtx.println(stderr, "Failed to open workspace data: %v", err)
+		return 1
+	}
+	uid, gid := os.Getuid(), os.Getgid()
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		uid, gid = int(stat.Uid), int(stat.Gid)
+	}
+	if err := daemon.ExtractTar(stdin, dir, uid, gid); err != nil {
+		connCtx.println(stderr, "Failed to import workspace data: %v", err)
+		return 1
+	}
+	log.Printf("(%v) Imported workspace data", connCtx.User)
+	return 0
+}
+
+func parseRootfsFlag(args []string) (rootfs bool, ok bool) {
+	switch {
+	case len(args) == 0:
+		return false, true
+	case len(args) == 1 && args[0] == "--rootfs":
+		return true, true
+	}
+	return false, false
+}
@@ -2,12 +2,15 @@ package sshd
 
 import (
 	"bubble/daemon"
+	"bubble/daemon/audit"
 	"bubble/daemon/manager"
 	"encoding/binary"
 	"fmt"
 	"log"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/docker/docker/api/types/container"
 	"golang.org/x/crypto/ssh"
@@ -17,18 +20,30 @@ func (connCtx *SshConnContext) handleConnection(conn net.Conn, sshConfig *ssh.Se
 	sshConn, channels, _requests, err := ssh.NewServerConn(conn, sshConfig)
 	if err != nil {
 		log.Println("SSH handshake failed:", err)
+		recordAuthFailure(connCtx.ServerContext.Audit, conn.RemoteAddr().String(), err)
 		return
 	}
 	log.Printf("New connection from %s as %s\n", sshConn.RemoteAddr(), sshConn.User())
+	connCtx.Remote = sshConn.RemoteAddr().String()
+	if sshConn.Permissions != nil {
+		connCtx.User = sshConn.Permissions.Extensions[userNameExtension]
+		connCtx.KeyName = sshConn.Permissions.Extensions[keyNameExtension]
+		connCtx.Fingerprint = sshConn.Permissions.Extensions[keyFingerprintExtension]
+	}
+	connCtx.audit(audit.Record{Type: audit.AuthSuccess})
 	connCtx.ServerContext.EventBus.Publish(ConnectionEstablishedEvent, NewConnectionEstablishedEvent(connCtx))
 	go connCtx.signalHandler(conn)
-	exitHandle := func() {
+	exitHandle := sync.OnceFunc(func() {
 		err := (conn).Close()
 		if err != nil && !connCtx.ServerContext.shuttingDown {
 			log.Printf("Failed to close connection: %v", err)
 		}
 		connCtx.ServerContext.EventBus.Publish(ConnectionCloseEvent, NewConnectionLostEvent(connCtx))
-	}
+		if connCtx.ContainerId != "" {
+			connCtx.audit(audit.Record{Type: audit.SessionEnd})
+		}
+	})
+	connCtx.closeHandle = exitHandle
 	go ssh.DiscardRequests(_requests)
 	newChannel := <-channels
 	// todo support env passthru
@@ -41,7 +56,12 @@ func (connCtx *SshConnContext) handleConnection(conn net.Conn, sshConfig *ssh.Se
 			return
 		}
 		connCtx.Conn = &channel
-		connCtx.User = sshConn.User()
+		if connCtx.User == "" {
+			log.Printf("Connection from %v has no validated user name", sshConn.RemoteAddr())
+			_ = channel.Close()
+			exitHandle()
+			return
+		}
 		containerId, containerTemplate, err := connCtx.prepareSession()
 		if err != nil || containerId == nil {
 			connCtx.logToBoth(fmt.Sprintf("Failed to handle session: %v", err))
@@ -49,11 +69,13 @@ func (connCtx *SshConnContext) handleConnection(conn net.Conn, sshConfig *ssh.Se
 			return
 		}
 
+		connCtx.Workspace = connCtx.Vars.Workspace
+		connCtx.ContainerId = *containerId
+		connCtx.Template = containerTemplate
+		connCtx.ServerContext.EventBus.PublishSync(SessionAttachedEvent, NewSessionAttachedEvent(connCtx))
+		connCtx.audit(audit.Record{Type: audit.SessionStart})
 		connCtx.registerEvents(containerTemplate, *containerId)
 		go connCtx.handleRequests(reqs)
-		connCtx.EventBus.Subscribe(ClientPipeBrokenEvent, func(_ string, _ *daemon.ServerEvent) {
-			exitHandle()
-		})
 		return
 	}
 }
@@ -67,29 +89,31 @@ func (connCtx *SshConnContext) signalHandler(listener net.Conn) {
 
 func (connCtx *SshConnContext) prepareSession() (id *string, config *daemon.ContainerConfig, err error) {
 	sctx := connCtx.ServerContext
-	user := connCtx.User
-	containerName := "workspace-" + user //todo refactor
-	containerTemplate, err := sctx.AppConfig.GetTemplateByUser(user)
+	containerTemplate, vars, err := sctx.WorkspaceTemplate(connCtx.User, connCtx.KeyName)
 	if err != nil {
 		log.Printf("Cannot find template for channel issued by %v: %v\n", connCtx.User, err)
 		return
 	}
+	connCtx.Vars = vars
+	if err = connCtx.checkQuota(containerTemplate); err != nil {
+		return nil, containerTemplate, err
+	}
 	connCtx.logToBoth(fmt.Sprintf("Preparing container for %v...", connCtx.User))
-	containerId, erro, _ := connCtx.ServerContext.PrepareContainer(
-		containerName,
-		connCtx.ServerContext.GetHostWorkspaceDir(connCtx.User),
-		containerTemplate)
+	containerId, erro, _ := connCtx.ServerContext.PrepareContainer(vars, containerTemplate, connCtx.PrintTextLn)
 	if erro != nil || containerId == nil {
 		erro = fmt.Errorf("error while preparing container: %v", erro)
 		return containerId, containerTemplate, erro
 	}
+	erro = daemon.RunHooks(sctx.context, sctx.DockerClient, *containerId, containerTemplate, daemon.HookPreAttach, vars, connCtx.PrintTextLn)
+	if erro != nil {
+		return nil, containerTemplate, erro
+	}
 	if containerTemplate.EnableManager {
 		ip, err := daemon.GetIpOfContainer(connCtx.ServerContext.DockerClient, *containerId)
-		if err == nil {
-			connCtx.ServerContext.EventBus.Publish(manager.ManagerContainerRegisteredEvent, manager.NewContainerRegisterEvent(*containerId, ip))
-		} else {
+		if err != nil && sctx.AppConfig.Load().Manager.Address != "" {
 			log.Println("Failed to get ip of container", containerId, err)
 		}
+		connCtx.ServerContext.EventBus.Publish(manager.ManagerContainerRegisteredEvent, manager.NewContainerRegisterEvent(*containerId, ip, vars.Workspace))
 	}
 	return containerId, containerTemplate, erro
 }
@@ -104,12 +128,13 @@ func (connCtx *SshConnContext) handleRequests(requests <-chan *ssh.Request) {
 			}
 		case "pty-req":
 			connCtx.Interactive = true
+			termLen := req.Payload[3]
+			// the size goes first, so that the exec and its recording start with it.
+			connCtx.EventBus.PublishSync(ClientResizeEvent, NewResizeEvent(req.Payload[termLen+4:]))
 			if !hasPty {
 				hasPty = true // then create for it!
 				connCtx.EventBus.PublishSync(ClientExecEvent, NewExecEvent(false, nil))
 			}
-			termLen := req.Payload[3]
-			connCtx.EventBus.Publish(ClientResizeEvent, NewResizeEvent(req.Payload[termLen+4:]))
 			_ = req.Reply(true, nil)
 		case "window-change":
 			connCtx.EventBus.Publish(ClientResizeEvent, NewResizeEvent(req.Payload))
@@ -127,6 +152,9 @@ func (connCtx *SshConnContext) handleRequests(requests <-chan *ssh.Request) {
 			}
 			cmd_s := string(req.Payload[4 : 4+command_len])
 			cmd := strings.Split(cmd_s, " ")
+			if connCtx.runBuiltinCommand(req, cmd) {
+				continue
+			}
 			connCtx.EventBus.Publish(ClientExecEvent, NewExecEvent(true, cmd))
 		default:
 			log.Printf("(%v) Unknown request type: %v", connCtx.User, req.Type)
@@ -141,28 +169,33 @@ func (connCtx *SshConnContext) handleSubsystemRequest(req *ssh.Request) error {
 		return fmt.Errorf("illegal packet length found from user %v, conn %v", connCtx.User, connCtx.Conn)
 	}
 	name := string(req.Payload[4 : 4+nameLen])
+	connCtx.audit(audit.Record{Type: audit.Subsystem, Action: name})
 	connCtx.EventBus.Publish(ClientSubsystemRequestEvent, NewSubsystemRequest(name))
 	return nil
 }
 
 type PtySession struct {
-	connCtx         *SshConnContext
-	containerId     string
-	lastCloseHandle func()
-	lastExecId      *string
+	connCtx     *SshConnContext
+	containerId string
+	lock        sync.Mutex
+	current     *ptyStream
+	// size is the last window size requested by the client, applied to every new exec.
+	size []byte
+	// share holds the shareMode chosen by the owner with bubble-share, off until then.
+	share atomic.Int32
 }
 
 func (connCtx *SshConnContext) registerEvents(containerTemplate *daemon.ContainerConfig, containerId string) {
 	pty := &PtySession{
-		connCtx:         connCtx,
-		containerId:     containerId,
-		lastCloseHandle: nil,
-		lastExecId:      nil,
+		connCtx:     connCtx,
+		containerId: containerId,
 	}
+	connCtx.pty.Store(pty)
 	ptyEventHandler := func(_ string, event *daemon.ServerEvent) {
 		err := pty.onPtyEvent(event, containerTemplate)
 		if err != nil {
 			log.Printf("(%v) Connection closed, message: %v", connCtx.User, err)
+			connCtx.closeHandle()
 			return
 		}
 	}
@@ -181,12 +214,22 @@ func (connCtx *SshConnContext) registerEvents(containerTemplate *daemon.Containe
 	})
 }
 
+// Stream returns the exec currently attached to the session, or nil.
+func (ptys *PtySession) Stream() *ptyStream {
+	ptys.lock.Lock()
+	defer ptys.lock.Unlock()
+	return ptys.current
+}
+
 func (ptys *PtySession) onPtyEvent(evt *daemon.ServerEvent, containerTemplate *daemon.ContainerConfig) error {
 	connCtx := ptys.connCtx
+	ptys.lock.Lock()
+	defer ptys.lock.Unlock()
 	et := evt.Type()
 	if et == ClientPipeBrokenEvent {
 		execId := BrokenPipeEvent(evt)
-		if execId == *ptys.lastExecId {
+		if ptys.current != nil && execId == ptys.current.execId {
+			ptys.current = nil
 			return fmt.Errorf("pipe is broken: %v", execId)
 		} else {
 			log.Printf("(%v) Pty exec switch detected.", connCtx.User)
@@ -196,33 +239,45 @@ func (ptys *PtySession) onPtyEvent(evt *daemon.ServerEvent, containerTemplate *d
 		if !silent {
 			connCtx.PrintTextLn("Redirecting to the container...")
 		}
+		connCtx.ServerContext.Workspaces.Touch(ptys.containerId)
 		if exec == nil {
 			exec = containerTemplate.Exec
 		}
-		ptys.lastExecId = nil // avoid closing connection
-		if ptys.lastCloseHandle != nil {
-			ptys.lastCloseHandle()
+		connCtx.audit(audit.Record{Type: audit.Exec, Command: exec})
+		if ptys.current != nil {
+			previous := ptys.current
+			ptys.current = nil // avoid closing connection
+			previous.Close()
 		}
-		closeHandle, execId, err := connCtx.RedirectToContainer(ptys.containerId, exec)
+		stream, err := connCtx.RedirectToContainer(ptys.containerId, exec, containerTemplate.User)
 		if err != nil {
 			connCtx.logToBoth(fmt.Sprintf("(%v) Failed to redirect to container: %v", ptys.containerId, err))
 			return err
 		}
-		ptys.lastExecId = execId
-		ptys.lastCloseHandle = closeHandle
+		ptys.current = stream
+		if ptys.size != nil {
+			ptys.resize(ptys.size)
+		}
 	} else if et == ClientResizeEvent {
-		if ptys.lastExecId == nil {
-			log.Printf("Cannot perform pty resize for %v since no pty is attached.", connCtx.User)
+		ptys.size = ResizeEventData(evt)
+		if ptys.current == nil {
 			return nil
 		}
-		w, h := ResizeEvent(evt)
-		err := connCtx.ServerContext.DockerClient.ContainerExecResize(connCtx.context, *ptys.lastExecId, container.ResizeOptions{
-			Height: h,
-			Width:  w,
-		})
-		if err != nil {
-			log.Printf("Failed to resize exec session: %v", err)
-		}
+		ptys.resize(ptys.size)
 	}
 	return nil
 }
+
+func (ptys *PtySession) resize(size []byte) {
+	w, h := decodeWindowSize(size)
+	err := ptys.connCtx.ServerContext.DockerClient.ContainerExecResize(ptys.connCtx.context, ptys.current.execId, container.ResizeOptions{
+		Height: h,
+		Width:  w,
+	})
+	if err != nil {
+		log.Printf("Failed to resize exec session: %v", err)
+	}
+	if ptys.current.recorder != nil {
+		ptys.current.recorder.Resize(w, h)
+	}
+}
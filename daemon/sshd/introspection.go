@@ -0,0 +1,63 @@
+package sshd
+
+import (
+	"bubble/daemon"
+	"bubble/daemon/manager"
+	"time"
+)
+
+// WorkspaceStatus implements manager.StatusProvider.
+func (sctx *SshServerContext) WorkspaceStatus(containerId string, user string, templateName string) *manager.WorkspaceStatus {
+	config := sctx.AppConfig.Load()
+	status := &manager.WorkspaceStatus{Sessions: make([]manager.SessionInfo, 0)}
+	for _, conn := range sctx.Workspaces.Sessions(containerId) {
+		status.Sessions = append(status.Sessions, manager.SessionInfo{
+			Id:          conn.SessionId,
+			User:        conn.User,
+			Key:         conn.KeyName,
+			Interactive: conn.Interactive,
+			Connected:   conn.Connected,
+		})
+	}
+	template, lastActive, tracked := sctx.Workspaces.activity(containerId)
+	if template == nil {
+		if t, ok := config.Templates[templateName]; ok {
+			template = &t
+		}
+	}
+	if template == nil {
+		return status
+	}
+	if tracked && (template.IdleStopAfter > 0 || template.DestroyAfter > 0) {
+		idle := &manager.IdleInfo{LastActive: lastActive}
+		if template.IdleStopAfter > 0 {
+			at := lastActive.Add(template.IdleStopAfter)
+			idle.StopAt = &at
+		}
+		if template.DestroyAfter > 0 {
+			at := lastActive.Add(template.DestroyAfter)
+			idle.DestroyAt = &at
+		}
+		status.Idle = idle
+	}
+	if quota := config.QuotaOf(user, template); quota != nil {
+		info := &manager.QuotaInfo{Limit: quota.Limit}
+		if usage, ok := sctx.DiskUsage.Get(user); ok {
+			info.Used = usage.Total(quota)
+			info.Scanned = usage.Scanned
+		}
+		status.Quota = info
+	}
+	return status
+}
+
+// activity returns the template of a tracked workspace and when it was last active.
+func (r *WorkspaceRegistry) activity(containerId string) (*daemon.ContainerConfig, time.Time, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	state, ok := r.workspaces[containerId]
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	return state.template, state.lastActive, true
+}
@@ -0,0 +1,140 @@
+package sshd
+
+import (
+	"bubble/daemon"
+	"log"
+	"strings"
+	"unicode"
+)
+
+// maxMessageLength caps messages, which are drawn over the top of terminals.
+const maxMessageLength = 512
+
+// noticeBacklog is how many messages may wait for a session, so that a stalled client can't hold up
+// the sender, e.g. shutdown. Further messages are dropped until it catches up.
+const noticeBacklog = 16
+
+// SendMessage prints a message to sessions of a user (by user or key name) and of a workspace
+// (by workspace name or the user it belongs to). Empty filters match every session.
+// It returns how many sessions took the message.
+func (sctx *SshServerContext) SendMessage(user string, workspace string, text string) int {
+	text = sanitizeMessage(text)
+	if text == "" {
+		return 0
+	}
+	recipients := make([]*SshConnContext, 0)
+	for _, conn := range sctx.Workspaces.AllSessions() {
+		if user != "" && conn.User != user && conn.KeyName != user {
+			continue
+		}
+		if workspace != "" && conn.Workspace != workspace && conn.Workspace != daemon.WorkspaceName(workspace) {
+			continue
+		}
+		recipients = append(recipients, conn)
+	}
+	sent := notifyAll(recipients, text)
+	log.Printf("Sent message to %v sessions (user %q, workspace %q): %v", sent, user, workspace, text)
+	return sent
+}
+
+// Broadcast prints a message to every session attached to a workspace, returning how many got it.
+func (sctx *SshServerContext) Broadcast(text string) int {
+	return sctx.SendMessage("", "", text)
+}
+
+// MessageWorkspace implements manager.StatusProvider, for messages sent by a workspace to its own sessions.
+func (sctx *SshServerContext) MessageWorkspace(containerId string, text string) int {
+	text = sanitizeMessage(text)
+	if text == "" {
+		return 0
+	}
+	return notifyAll(sctx.Workspaces.Sessions(containerId), text)
+}
+
+// notifyAll queues a message to sessions, returning how many accepted it.
+func notifyAll(sessions []*SshConnContext, text string) int {
+	delivered := 0
+	for _, conn := range sessions {
+		if conn.queueNotice(text) {
+			delivered++
+		}
+	}
+	return delivered
+}
+
+// queueNotice queues a message for the session without blocking, or drops it if the queue is full.
+// A single writer per session shows the queued messages, and exits once the queue is empty.
+func (connCtx *SshConnContext) queueNotice(text string) bool {
+	select {
+	case connCtx.notices <- text:
+	default:
+		return false
+	}
+	connCtx.noticeLock.Lock()
+	defer connCtx.noticeLock.Unlock()
+	if !connCtx.noticeWriter {
+		connCtx.noticeWriter = true
+		go connCtx.writeNotices()
+	}
+	return true
+}
+
+func (connCtx *SshConnContext) writeNotices() {
+	for {
+		select {
+		case text := <-connCtx.notices:
+			connCtx.Notify(text)
+		default:
+			connCtx.noticeLock.Lock()
+			if len(connCtx.notices) == 0 {
+				connCtx.noticeWriter = false
+				connCtx.noticeLock.Unlock()
+				return
+			}
+			connCtx.noticeLock.Unlock()
+		}
+	}
+}
+
+// sanitizeMessage removes control characters, so a message can't move the cursor or change the terminal
+// on its own, and truncates it.
+func sanitizeMessage(text string) string {
+	text = strings.Map(func(r rune) rune {
+		if r == '\n' {
+			return r
+		}
+		if r == '\t' {
+			return ' '
+		}
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(text))
+	if runes := []rune(text); len(runes) > maxMessageLength {
+		text = string(runes[:maxMessageLength])
+	}
+	return text
+}
+
+// Notify shows a message from bubble. On terminals it's drawn over the top lines and the cursor is put back,
+// so full-screen programs keep drawing where they were. They may redraw over it.
+func (connCtx *SshConnContext) Notify(text string) {
+	if !connCtx.Interactive {
+		connCtx.PrintTextLn("[bubble] " + text)
+		return
+	}
+	var b strings.Builder
+	// save the cursor and attributes, go to the top left.
+	b.WriteString("\x1b7\x1b[1;1H")
+	for i, line := range strings.Split("[bubble] "+text, "\n") {
+		if i > 0 {
+			b.WriteString("\r\n")
+		}
+		// reverse video, then clear the rest of the line.
+		b.WriteString("\x1b[7m" + line + "\x1b[0m\x1b[K")
+	}
+	// restore the cursor and attributes.
+	b.WriteString("\x1b8")
+	connCtx.writeText(b.String())
+}
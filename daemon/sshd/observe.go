@@ -0,0 +1,72 @@
+package sshd
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// observableSessions returns sessions with a terminal which the key of connCtx may watch.
+func (connCtx *SshConnContext) observableSessions() []*SshConnContext {
+	config := connCtx.ServerContext.AppConfig.Load()
+	var sessions []*SshConnContext
+	for _, conn := range connCtx.ServerContext.Workspaces.AllSessions() {
+		if conn == connCtx || conn.stream() == nil {
+			continue
+		}
+		if config.CanObserve(connCtx.KeyName, conn.User) {
+			sessions = append(sessions, conn)
+		}
+	}
+	return sessions
+}
+
+func observeCommand(connCtx *SshConnContext, args []string, stdout io.Writer, stderr io.Writer) int {
+	sessions := connCtx.observableSessions()
+	if len(args) == 0 {
+		for _, conn := range sessions {
+			connCtx.println(stdout, "%v\t%v\t%v\t%v", conn.SessionId, conn.User, conn.displayName(), conn.Connected.Format("2006-01-02 15:04:05"))
+		}
+		return 0
+	}
+	if len(args) > 2 {
+		connCtx.println(stderr, "Usage: bubble-observe [user [session id]]")
+		return 2
+	}
+	if !connCtx.Interactive {
+		connCtx.println(stderr, "bubble-observe needs a terminal, try ssh -t.")
+		return 2
+	}
+	var matches []*SshConnContext
+	for _, conn := range sessions {
+		if conn.User != args[0] {
+			continue
+		}
+		if len(args) == 2 && strconv.FormatUint(conn.SessionId, 10) != args[1] {
+			continue
+		}
+		matches = append(matches, conn)
+	}
+	if len(matches) == 0 {
+		connCtx.println(stderr, "No session of %v that you may observe.", args[0])
+		return 1
+	}
+	if len(matches) > 1 {
+		connCtx.println(stderr, "%v has %v sessions, pick one by id:", args[0], len(matches))
+		for _, conn := range matches {
+			connCtx.println(stderr, "%v\t%v", conn.SessionId, conn.displayName())
+		}
+		return 1
+	}
+	target := matches[0]
+	stream := target.stream()
+	if stream == nil {
+		connCtx.println(stderr, "The session has ended.")
+		return 1
+	}
+	target.PrintTextLn(fmt.Sprintf("\r\n[bubble] %v is watching your session.", connCtx.displayName()))
+	connCtx.println(stdout, "Watching the session of %v read-only, press Ctrl-] to leave.", target.displayName())
+	connCtx.attachStream(stream, false, nil)
+	target.PrintTextLn(fmt.Sprintf("\r\n[bubble] %v stopped watching your session.", connCtx.displayName()))
+	return 0
+}
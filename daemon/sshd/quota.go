@@ -0,0 +1,123 @@
+package sshd
+
+import (
+	"bubble/daemon"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/docker/go-units"
+)
+
+// UsageTracker keeps the last measured disk usage of each user's workspace.
+type UsageTracker struct {
+	lock  sync.Mutex
+	usage map[string]daemon.DiskUsage
+}
+
+func newUsageTracker() *UsageTracker {
+	return &UsageTracker{usage: make(map[string]daemon.DiskUsage)}
+}
+
+func (t *UsageTracker) Get(user string) (daemon.DiskUsage, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	usage, ok := t.usage[user]
+	return usage, ok
+}
+
+func (t *UsageTracker) set(user string, usage daemon.DiskUsage) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.usage[user] = usage
+}
+
+// runQuotaScanner periodically measures workspaces which are subject to a quota.
+func (sctx *SshServerContext) runQuotaScanner() {
+	interval := sctx.AppConfig.Load().QuotaScan
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		sctx.scanQuotas()
+		select {
+		case <-sctx.context.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (sctx *SshServerContext) scanQuotas() {
+	containers, err := daemon.ListWorkspaceContainers(sctx.context, sctx.DockerClient)
+	if err != nil {
+		log.Printf("(quota) Failed to list workspaces: %v", err)
+		return
+	}
+	config := sctx.AppConfig.Load()
+	for _, c := range containers {
+		user := c.Labels[daemon.LabelUser]
+		template, ok := config.Templates[c.Labels[daemon.LabelTemplate]]
+		if !ok || user == "" {
+			continue
+		}
+		quota := config.QuotaOf(user, &template)
+		if quota == nil {
+			continue
+		}
+		usage := sctx.measureUsage(user, c.ID, quota)
+		if total := usage.Total(quota); total >= quota.Limit {
+			log.Printf("(quota) %v is over quota: %v of %v", user, units.HumanSize(float64(total)), units.HumanSize(float64(quota.Limit)))
+		}
+	}
+}
+
+// measureUsage scans the workspace of a user now. containerId may be empty if there is no container yet.
+func (sctx *SshServerContext) measureUsage(user string, containerId string, quota *daemon.Quota) daemon.DiskUsage {
+	usage := daemon.DiskUsage{Scanned: time.Now()}
+	var err error
+	if dir := sctx.WorkspaceVars(user, "").WorkspaceDir; dir != "" {
+		if usage.Data, err = daemon.DirSize(dir); err != nil {
+			log.Printf("(quota) Failed to measure workspace data of %v: %v", user, err)
+		}
+	}
+	if quota.IncludeRootfs && containerId != "" {
+		if usage.Rootfs, err = daemon.ContainerRootfsSize(sctx.context, sctx.DockerClient, containerId); err != nil {
+			log.Printf("(quota) Failed to measure container of %v: %v", user, err)
+		}
+	}
+	sctx.DiskUsage.set(user, usage)
+	return usage
+}
+
+// checkQuota warns the user when the workspace is close to its quota, and refuses to start it when over.
+// A workspace already running is left alone so its owner can clean up.
+func (connCtx *SshConnContext) checkQuota(containerTemplate *daemon.ContainerConfig) error {
+	sctx := connCtx.ServerContext
+	quota := sctx.AppConfig.Load().QuotaOf(connCtx.User, containerTemplate)
+	if quota == nil {
+		return nil
+	}
+	exists, status, containerId := daemon.ContainerExists(sctx.DockerClient, connCtx.Vars.Workspace)
+	usage, ok := sctx.DiskUsage.Get(connCtx.User)
+	// usage over the limit is measured again, since the scanner only covers users with a container
+	// and one who freed up space would otherwise stay locked out.
+	if !ok || usage.Total(quota) >= quota.Limit {
+		usage = sctx.measureUsage(connCtx.User, containerId, quota)
+	}
+	total := usage.Total(quota)
+	summary := fmt.Sprintf("%v of %v (%.0f%%)", units.HumanSize(float64(total)), units.HumanSize(float64(quota.Limit)),
+		float64(total)*100/float64(quota.Limit))
+	if total >= quota.Limit {
+		if !exists || status != daemon.ContainerStatusUp {
+			return fmt.Errorf("disk quota exceeded: %v used, the workspace won't be started", summary)
+		}
+		connCtx.PrintTextLn(fmt.Sprintf("WARNING: disk quota exceeded, %v used. The workspace won't start again until you free up space.", summary))
+	} else if float64(total) >= float64(quota.Limit)*quota.WarnAt {
+		connCtx.PrintTextLn(fmt.Sprintf("WARNING: this workspace is close to its disk quota, %v used.", summary))
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package sshd
+
+import (
+	"bubble/daemon"
+	"bubble/daemon/manager"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	reaperInterval   = 15 * time.Second
+	reaperWarnBefore = time.Minute
+)
+
+type reaperAction int
+
+const (
+	reaperNone reaperAction = iota
+	reaperWarnStop
+	reaperWarnDestroy
+	reaperStop
+	reaperDestroy
+)
+
+// runReaper stops and removes workspaces that stayed idle longer than idle-stop-after and destroy-after of their templates.
+func (sctx *SshServerContext) runReaper() {
+	sctx.seedWorkspaces()
+	ticker := time.NewTicker(reaperInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sctx.context.Done():
+			return
+		case <-ticker.C:
+			sctx.reap()
+		}
+	}
+}
+
+// seedWorkspaces tracks containers which were created before the daemon (re)started, so they can still be reaped.
+func (sctx *SshServerContext) seedWorkspaces() {
+	containers, err := daemon.ListWorkspaceContainers(sctx.context, sctx.DockerClient)
+	if err != nil {
+		log.Printf("(reaper) Failed to list workspaces: %v", err)
+		return
+	}
+	config := sctx.AppConfig.Load()
+	registry := sctx.Workspaces
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	for _, c := range containers {
+		template, ok := config.Templates[c.Labels[daemon.LabelTemplate]]
+		if !ok {
+			continue
+		}
+		state := registry.track(c.ID, c.Labels[daemon.LabelWorkspace], &template)
+		state.stopped = c.State != daemon.ContainerStatusRunning
+	}
+}
+
+func (sctx *SshServerContext) reap() {
+	config := sctx.AppConfig.Load()
+	registry := sctx.Workspaces
+	type pending struct {
+		state   *workspaceState
+		action  reaperAction
+		idle    time.Duration
+		stopped bool
+	}
+	actions := make([]pending, 0)
+	registry.lock.Lock()
+	for _, state := range registry.workspaces {
+		idle := time.Since(state.lastActive)
+		if action := state.nextReaperAction(idle); action != reaperNone {
+			actions = append(actions, pending{state, action, idle, state.stopped})
+			switch action {
+			case reaperWarnStop, reaperWarnDestroy:
+				state.warned = true
+			case reaperStop:
+				state.stopped = true
+			}
+		}
+	}
+	registry.lock.Unlock()
+
+	for _, p := range actions {
+		state := p.state
+		template := state.template
+		switch p.action {
+		case reaperWarnStop:
+			sctx.warnWorkspace(state, fmt.Sprintf("This workspace has been idle for %v and will be stopped in %v.",
+				p.idle.Round(time.Second), (template.IdleStopAfter-p.idle).Round(time.Second)))
+		case reaperWarnDestroy:
+			sctx.warnWorkspace(state, fmt.Sprintf("This workspace has been idle for %v and will be DESTROYED in %v.",
+				p.idle.Round(time.Second), (template.DestroyAfter-p.idle).Round(time.Second)))
+		case reaperStop:
+			log.Printf("(reaper) Stopping %v, idle for %v", state.name, p.idle.Round(time.Second))
+			if daemon.ContainerGone(sctx.context, sctx.DockerClient, state.containerId) {
+				sctx.forgetRemoved(state.containerId)
+				continue
+			}
+			daemon.RunPreStopHooks(sctx.context, sctx.DockerClient, config, state.containerId)
+			if err := daemon.StopContainer(sctx.context, sctx.DockerClient, state.containerId); err != nil {
+				log.Printf("(reaper) %v", err)
+			}
+		case reaperDestroy:
+			log.Printf("(reaper) Destroying %v, idle for %v", state.name, p.idle.Round(time.Second))
+			if !p.stopped {
+				daemon.RunPreStopHooks(sctx.context, sctx.DockerClient, config, state.containerId)
+			}
+			if err := daemon.DestroyContainer(sctx.context, sctx.DockerClient, state.containerId); err != nil {
+				log.Printf("(reaper) %v", err)
+				continue
+			}
+			sctx.forgetRemoved(state.containerId)
+		}
+	}
+}
+
+// forgetRemoved drops a container that was removed, by the reaper or outside of bubble.
+func (sctx *SshServerContext) forgetRemoved(containerId string) {
+	sctx.Workspaces.forget(containerId)
+	sctx.EventBus.Publish(manager.ManagerContainerRemovedEvent, manager.NewContainerRemovedEvent(containerId))
+}
+
+// nextReaperAction decides what to do with a workspace. It must be called with the registry locked.
+func (state *workspaceState) nextReaperAction(idle time.Duration) reaperAction {
+	template := state.template
+	if template == nil {
+		return reaperNone
+	}
+	if template.DestroyAfter > 0 {
+		if idle >= template.DestroyAfter {
+			return reaperDestroy
+		}
+		if len(state.sessions) > 0 && !state.warned && idle >= template.DestroyAfter-warnPeriod(template.DestroyAfter) {
+			return reaperWarnDestroy
+		}
+	}
+	if template.IdleStopAfter > 0 && !state.stopped {
+		if idle >= template.IdleStopAfter {
+			return reaperStop
+		}
+		if len(state.sessions) > 0 && !state.warned && idle >= template.IdleStopAfter-warnPeriod(template.IdleStopAfter) {
+			return reaperWarnStop
+		}
+	}
+	return reaperNone
+}
+
+func warnPeriod(after time.Duration) time.Duration {
+	return min(reaperWarnBefore, after/2)
+}
+
+func (sctx *SshServerContext) warnWorkspace(state *workspaceState, message string) {
+	for _, conn := range sctx.Workspaces.Sessions(state.containerId) {
+		conn.PrintTextLn("\r\n[bubble] " + message + " Type anything to keep it alive.")
+	}
+}
@@ -0,0 +1,331 @@
+package sshd
+
+import (
+	"bubble/daemon"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+)
+
+// detachKey (Ctrl-]) leaves a joined session.
+const detachKey = 0x1d
+
+// viewerBacklog is how many chunks of output a joined session may fall behind before it is detached.
+const viewerBacklog = 256
+
+// shareMode is what the owner of a session lets other members of the workspace do with bubble-join.
+type shareMode int32
+
+const (
+	shareOff shareMode = iota
+	shareRead
+	shareWrite
+)
+
+var shareModeNames = []string{"off", "read", "write"}
+
+func (m shareMode) String() string {
+	return shareModeNames[m]
+}
+
+func parseShareMode(name string) (shareMode, bool) {
+	for i, modeName := range shareModeNames {
+		if modeName == name {
+			return shareMode(i), true
+		}
+	}
+	return shareOff, false
+}
+
+// ptyStream is the exec currently attached to a session. Its output is also sent to other sessions
+// which joined it, and those which aren't read-only can type into it as well.
+type ptyStream struct {
+	execId   string
+	owner    *SshConnContext
+	input    io.Writer
+	closer   func()
+	lock     sync.Mutex
+	viewers  map[*SshConnContext]*streamViewer
+	done     chan struct{}
+	recorder *daemon.Recorder
+}
+
+func newPtyStream(owner *SshConnContext, execId string, input io.Writer, closer func(), recorder *daemon.Recorder) *ptyStream {
+	if recorder != nil && owner.Template.Recording.Input {
+		input = io.MultiWriter(input, recorder.Input())
+	}
+	return &ptyStream{
+		execId:   execId,
+		owner:    owner,
+		input:    input,
+		closer:   closer,
+		viewers:  make(map[*SshConnContext]*streamViewer),
+		done:     make(chan struct{}),
+		recorder: recorder,
+	}
+}
+
+// streamViewer is a session which joined a stream. Output is queued to it and written by its own goroutine,
+// so that a stalled viewer can't hold up the owner's terminal.
+type streamViewer struct {
+	output chan []byte
+	// joined is set for viewers which came through bubble-join rather than bubble-observe.
+	joined bool
+	// detached is closed when the stream detached the viewer, telling why in notice.
+	detached chan struct{}
+	notice   string
+	// drained is closed once the queued output was written.
+	drained chan struct{}
+}
+
+// Write copies output of the exec to joined sessions. It never fails nor blocks, so it doesn't break
+// the owner's io.Copy. Viewers whose backlog is full are detached.
+func (s *ptyStream) Write(p []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for conn, viewer := range s.viewers {
+		select {
+		case viewer.output <- bytes.Clone(p):
+		default:
+			s.detach(conn, viewer, "Detached, the connection couldn't keep up with the session.")
+		}
+	}
+	return len(p), nil
+}
+
+// detach drops a viewer from the stream. It must be called with the stream locked.
+func (s *ptyStream) detach(conn *SshConnContext, viewer *streamViewer, notice string) {
+	delete(s.viewers, conn)
+	close(viewer.output)
+	viewer.notice = notice
+	close(viewer.detached)
+}
+
+// detachJoined drops the viewers which joined through bubble-join, once the owner stops sharing.
+func (s *ptyStream) detachJoined() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for conn, viewer := range s.viewers {
+		if viewer.joined {
+			s.detach(conn, viewer, "Detached, the owner stopped sharing the session.")
+		}
+	}
+}
+
+func (s *ptyStream) join(conn *SshConnContext, joined bool) *streamViewer {
+	viewer := &streamViewer{
+		output:   make(chan []byte, viewerBacklog),
+		joined:   joined,
+		detached: make(chan struct{}),
+		drained:  make(chan struct{}),
+	}
+	go func() {
+		defer close(viewer.drained)
+		for data := range viewer.output {
+			_, _ = conn.terminal().Write(data)
+		}
+	}()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.viewers[conn] = viewer
+	return viewer
+}
+
+func (s *ptyStream) leave(conn *SshConnContext) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if viewer, ok := s.viewers[conn]; ok {
+		delete(s.viewers, conn)
+		close(viewer.output)
+	}
+}
+
+// finish is called once the exec has no more output.
+func (s *ptyStream) finish() {
+	close(s.done)
+	if s.recorder != nil {
+		s.recorder.Close()
+	}
+}
+
+func (s *ptyStream) Close() {
+	s.closer()
+}
+
+// attachStream relays a stream to this session until the stream ends, the session closes or the user presses the detach key.
+// Input is forwarded while canWrite allows it, which is nil for read-only viewers.
+func (connCtx *SshConnContext) attachStream(stream *ptyStream, joined bool, canWrite func() bool) {
+	viewer := stream.join(connCtx, joined)
+	inputDone := make(chan struct{})
+	go func() {
+		defer close(inputDone)
+		buf := make([]byte, 1024)
+		for {
+			n, err := (*connCtx.Conn).Read(buf)
+			if n > 0 {
+				data := buf[:n]
+				index := bytes.IndexByte(data, detachKey)
+				if index >= 0 {
+					data = data[:index]
+				}
+				if canWrite != nil && canWrite() && len(data) > 0 {
+					connCtx.ServerContext.Workspaces.Touch(connCtx.ContainerId)
+					_, _ = stream.input.Write(data)
+				}
+				if index >= 0 {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	var notice string
+	select {
+	case <-stream.done:
+		notice = "The session has ended."
+	case <-inputDone:
+		notice = "Detached."
+	case <-viewer.detached:
+		notice = viewer.notice
+	}
+	stream.leave(connCtx)
+	// the notice goes after the queued output, rather than into the middle of it.
+	<-viewer.drained
+	connCtx.PrintTextLn("\r\n[bubble] " + notice)
+}
+
+// stream returns the exec attached to the session, or nil.
+func (connCtx *SshConnContext) stream() *ptyStream {
+	if pty := connCtx.pty.Load(); pty != nil {
+		return pty.Stream()
+	}
+	return nil
+}
+
+// shareMode returns how the owner shares the session.
+func (connCtx *SshConnContext) shareMode() shareMode {
+	if pty := connCtx.pty.Load(); pty != nil {
+		return shareMode(pty.share.Load())
+	}
+	return shareOff
+}
+
+// setShareMode changes how the session is shared, detaching joined sessions when sharing stops.
+func (connCtx *SshConnContext) setShareMode(mode shareMode) bool {
+	pty := connCtx.pty.Load()
+	if pty == nil {
+		return false
+	}
+	pty.share.Store(int32(mode))
+	if stream := pty.Stream(); mode == shareOff && stream != nil {
+		stream.detachJoined()
+	}
+	return true
+}
+
+// findSession looks up a session attached to a container by session id or key name.
+func (sctx *SshServerContext) findSession(containerId string, who string, except *SshConnContext) *SshConnContext {
+	for _, conn := range sctx.Workspaces.Sessions(containerId) {
+		if conn == except || conn.stream() == nil {
+			continue
+		}
+		if strconv.FormatUint(conn.SessionId, 10) == who || conn.KeyName == who {
+			return conn
+		}
+	}
+	return nil
+}
+
+func joinCommand(connCtx *SshConnContext, args []string, stdout io.Writer, stderr io.Writer) int {
+	if len(args) != 1 {
+		connCtx.println(stderr, "Usage: bubble-join <session id|key name>")
+		return 2
+	}
+	if !connCtx.Interactive {
+		connCtx.println(stderr, "bubble-join needs a terminal, try ssh -t.")
+		return 2
+	}
+	target := connCtx.ServerContext.findSession(connCtx.ContainerId, args[0], connCtx)
+	if target == nil {
+		connCtx.println(stderr, "No session of %v with a terminal in this workspace.", args[0])
+		return 1
+	}
+	mode := target.shareMode()
+	if mode == shareOff {
+		connCtx.println(stderr, "%v doesn't share the session, see bubble-share.", target.displayName())
+		return 1
+	}
+	stream := target.stream()
+	if stream == nil {
+		connCtx.println(stderr, "The session has ended.")
+		return 1
+	}
+	access := "read-only"
+	if mode == shareWrite {
+		access = "read-write"
+	}
+	target.PrintTextLn(fmt.Sprintf("\r\n[bubble] %v joined your session %v.", connCtx.displayName(), access))
+	connCtx.println(stdout, "Joined the session of %v %v, press Ctrl-] to leave.", target.displayName(), access)
+	// the owner may change their mind while joined, so writes are checked against the current mode.
+	connCtx.attachStream(stream, true, func() bool {
+		return target.shareMode() == shareWrite
+	})
+	target.PrintTextLn(fmt.Sprintf("\r\n[bubble] %v left your session.", connCtx.displayName()))
+	return 0
+}
+
+// shareCommand lets the owner of a session, i.e. the same key, allow others to join it with bubble-join.
+// Sessions aren't shared until their owner runs e.g. `bubble-share $BUBBLE_SESSION read`.
+func shareCommand(connCtx *SshConnContext, args []string, stdout io.Writer, stderr io.Writer) int {
+	if len(args) < 1 || len(args) > 2 {
+		connCtx.println(stderr, "Usage: bubble-share <session id> [off|read|write]")
+		return 2
+	}
+	var target *SshConnContext
+	for _, conn := range connCtx.ServerContext.Workspaces.Sessions(connCtx.ContainerId) {
+		if strconv.FormatUint(conn.SessionId, 10) == args[0] && conn.KeyName == connCtx.KeyName {
+			target = conn
+		}
+	}
+	if target == nil {
+		connCtx.println(stderr, "You have no session %v in this workspace.", args[0])
+		return 1
+	}
+	if len(args) == 1 {
+		connCtx.println(stdout, "%v", target.shareMode())
+		return 0
+	}
+	mode, ok := parseShareMode(args[1])
+	if !ok {
+		connCtx.println(stderr, "Usage: bubble-share <session id> [off|read|write]")
+		return 2
+	}
+	if !target.setShareMode(mode) {
+		connCtx.println(stderr, "The session has no terminal.")
+		return 1
+	}
+	switch mode {
+	case shareOff:
+		target.PrintTextLn("\r\n[bubble] Your session is no longer shared.")
+	case shareRead:
+		target.PrintTextLn("\r\n[bubble] Your session is shared read-only, members can join it with bubble-join.")
+	case shareWrite:
+		target.PrintTextLn("\r\n[bubble] Your session is shared, members can join it with bubble-join and type into it.")
+	}
+	return 0
+}
+
+func sessionsCommand(connCtx *SshConnContext, args []string, stdout io.Writer, stderr io.Writer) int {
+	for _, conn := range connCtx.ServerContext.Workspaces.Sessions(connCtx.ContainerId) {
+		terminal, share := "-", "-"
+		if conn.stream() != nil {
+			terminal, share = "tty", conn.shareMode().String()
+		}
+		connCtx.println(stdout, "%v\t%v\t%v\t%v\t%v", conn.SessionId, conn.displayName(), terminal, share, conn.Connected.Format("2006-01-02 15:04:05"))
+	}
+	return 0
+}
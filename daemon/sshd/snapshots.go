@@ -0,0 +1,118 @@
+package sshd
+
+import (
+	"bubble/daemon"
+	"bubble/daemon/manager"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/docker/go-units"
+)
+
+// SnapshotWorkspace commits the workspace container of a user to a new snapshot.
+func (sctx *SshServerContext) SnapshotWorkspace(user string) (string, error) {
+	exists, _, containerId := daemon.ContainerExists(sctx.DockerClient, sctx.WorkspaceVars(user, "").Workspace)
+	if !exists {
+		return "", fmt.Errorf("workspace of %v doesn't exist", user)
+	}
+	tag, err := daemon.CreateSnapshot(sctx.context, sctx.DockerClient, containerId, user, sctx.AppConfig.Load().Snapshots)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("Created snapshot %v of %v", tag, user)
+	return tag, nil
+}
+
+// RestoreWorkspace replaces the workspace container of a user with one created from a snapshot.
+// Data under the workspace directory is kept as it lives on the host.
+func (sctx *SshServerContext) RestoreWorkspace(user string, key string, tag string, report func(string)) error {
+	if !daemon.IsSnapshotOf(tag, user) {
+		return fmt.Errorf("%v is not a snapshot of %v", tag, user)
+	}
+	report(fmt.Sprintf("Restoring from %v...", tag))
+	err := sctx.recreateWorkspace(user, key, tag, report)
+	if err == nil {
+		log.Printf("Restored workspace of %v from %v", user, tag)
+	}
+	return err
+}
+
+// WorkspaceKey returns the key the workspace of a user was created with, or "" if there is none.
+func (sctx *SshServerContext) WorkspaceKey(user string) string {
+	exists, _, containerId := daemon.ContainerExists(sctx.DockerClient, sctx.WorkspaceVars(user, "").Workspace)
+	if !exists {
+		return ""
+	}
+	info, err := sctx.DockerClient.ContainerInspect(sctx.context, containerId)
+	if err != nil || info.Config == nil {
+		return ""
+	}
+	return info.Config.Labels[daemon.LabelKey]
+}
+
+// recreateWorkspace removes the workspace container of a user and creates a new one from the image,
+// which is expected to be derived from the workspace already, so post-create hooks are skipped.
+func (sctx *SshServerContext) recreateWorkspace(user string, key string, image string, report func(string)) error {
+	containerTemplate, vars, err := sctx.WorkspaceTemplate(user, key)
+	if err != nil {
+		return err
+	}
+	if exists, _, containerId := daemon.ContainerExists(sctx.DockerClient, vars.Workspace); exists {
+		report("Removing the current workspace...")
+		daemon.RunPreStopHooks(sctx.context, sctx.DockerClient, sctx.AppConfig.Load(), containerId)
+		if err := daemon.DestroyContainer(sctx.context, sctx.DockerClient, containerId); err != nil {
+			return err
+		}
+		sctx.Workspaces.forget(containerId)
+		sctx.EventBus.Publish(manager.ManagerContainerRemovedEvent, manager.NewContainerRemovedEvent(containerId))
+	}
+	containerTemplate.Image = image
+	containerTemplate.Build = nil
+	containerTemplate.PullPolicy = daemon.PullNever
+	if containerTemplate.Hooks != nil {
+		hooks := *containerTemplate.Hooks
+		hooks.PostCreate = nil
+		containerTemplate.Hooks = &hooks
+	}
+	_, err, _ = sctx.PrepareContainer(vars, containerTemplate, report)
+	return err
+}
+
+func snapshotCommand(connCtx *SshConnContext, args []string, stdout io.Writer, stderr io.Writer) int {
+	sctx := connCtx.ServerContext
+	action := "list"
+	if len(args) > 0 {
+		action = args[0]
+	}
+	switch {
+	case action == "list" && len(args) <= 1:
+		snapshots, err := daemon.ListSnapshots(sctx.context, sctx.DockerClient, connCtx.User)
+		if err != nil {
+			connCtx.println(stderr, "Failed to list snapshots: %v", err)
+			return 1
+		}
+		for _, snapshot := range snapshots {
+			connCtx.println(stdout, "%v\t%v\t%v", snapshot.Tag, snapshot.Created.Format("2006-01-02 15:04:05"), units.HumanSize(float64(snapshot.Size)))
+		}
+	case action == "create" && len(args) == 1:
+		tag, err := sctx.SnapshotWorkspace(connCtx.User)
+		if err != nil {
+			connCtx.println(stderr, "Failed to create snapshot: %v", err)
+			return 1
+		}
+		connCtx.println(stdout, "%v", tag)
+	case action == "restore" && len(args) == 2:
+		err := sctx.RestoreWorkspace(connCtx.User, connCtx.KeyName, args[1], func(line string) {
+			connCtx.println(stderr, "%v", line)
+		})
+		if err != nil {
+			connCtx.println(stderr, "Failed to restore snapshot: %v", err)
+			return 1
+		}
+	default:
+		connCtx.println(stderr, "Usage: bubble-snapshot [list|create|restore <tag>]")
+		return 2
+	}
+	return 0
+}
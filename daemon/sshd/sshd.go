@@ -2,16 +2,20 @@ package sshd
 
 import (
 	"bubble/daemon"
-	"bubble/daemon/forwarder"
+	"bubble/daemon/admin"
+	"bubble/daemon/audit"
 	"bubble/daemon/manager"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"os"
-	"path/filepath"
+	"path"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/client"
@@ -19,51 +23,100 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
+// Extensions carrying what was found during authentication to the connection.
+const (
+	keyNameExtension        = "key-name"
+	keyFingerprintExtension = "key-fingerprint"
+	userNameExtension       = "user-name"
+)
+
 type SshServerContext struct {
 	context      context.Context
 	wg           *sync.WaitGroup
 	shuttingDown bool
 	cancel       func()
-	serverConfig *ssh.ServerConfig
+	// serverConfig is replaced on reload, so it's read for every connection.
+	serverConfig atomic.Pointer[ssh.ServerConfig]
+	privateKey   ssh.Signer
+	listener     net.Listener
+	manager      *manager.ManagerContext
+	// ConfigPath is where the config is reloaded from.
+	ConfigPath   string
 	DockerClient *client.Client
-	AppConfig    *daemon.Config
-	EventBus     *eventbus.EventBus
+	// AppConfig is replaced on reload, so it's loaded once per operation rather than dereferenced.
+	AppConfig  atomic.Pointer[daemon.Config]
+	reloadLock sync.Mutex
+	EventBus   *eventbus.EventBus
+	Workspaces *WorkspaceRegistry
+	DiskUsage  *UsageTracker
+	Audit      *audit.Logger
+	// sessionIds numbers sessions so they can be told apart, e.g. by bubble-join.
+	sessionIds  atomic.Uint64
+	connections atomic.Int64
+	// draining refuses new connections, so the daemon can stop once the last one is gone.
+	draining atomic.Bool
 }
 
 func CreateSshServer(parent context.Context, client *client.Client, config *daemon.Config) *SshServerContext {
 	privateKey := loadPrivateKey(config.ServerKey)
+	auditor, err := audit.New(config.Audit)
+	if err != nil {
+		log.Fatalf("Failed to set up audit log: %v", err)
+	}
 	sshConfig := setupSSHConfig(privateKey, config)
 	ctx, cancel := context.WithCancel(parent)
 	sctx := SshServerContext{
 		DockerClient: client,
-		AppConfig:    config,
 		EventBus:     eventbus.New(),
+		Workspaces:   newWorkspaceRegistry(),
+		DiskUsage:    newUsageTracker(),
+		Audit:        auditor,
 		cancel:       cancel,
 		context:      ctx,
 		wg:           &sync.WaitGroup{},
 		shuttingDown: false,
-		serverConfig: sshConfig,
+		privateKey:   privateKey,
 	}
+	sctx.AppConfig.Store(config)
+	sctx.serverConfig.Store(sshConfig)
 	return &sctx
 }
 
-func (sctx *SshServerContext) Serve(address string) {
-	sshConfig := sctx.serverConfig
+// Start listens on address and starts the manager, the admin API and background tasks. Connections
+// are accepted by Serve afterwards, so that startup errors reach the caller before anything else runs.
+func (sctx *SshServerContext) Start(address string) error {
 	listener, err := net.Listen("tcp", address)
 	if err != nil {
-		log.Fatalf("Failed to listen on address %s: %v", address, err)
+		return fmt.Errorf("failed to listen on address %s: %v", address, err)
 	}
-	log.Printf("Listening on %s...\n", address)
-	go sctx.signalListener(listener)
-	go sctx.eventHandler()
-	_, err = manager.StartManagementServer(
+	mctx, err := manager.StartManagementServer(
 		sctx.DockerClient,
-		sctx.AppConfig.Manager,
+		&sctx.AppConfig,
 		sctx.EventBus,
+		sctx.Audit,
 		sctx.context)
 	if err != nil {
-		log.Fatalf("Failed to start manager server: %v", err)
+		_ = listener.Close()
+		return fmt.Errorf("failed to start manager server: %v", err)
+	}
+	mctx.SetStatusProvider(sctx)
+	sctx.manager = mctx
+	if err := admin.Serve(sctx.context, sctx.AppConfig.Load().Admin, sctx); err != nil {
+		_ = listener.Close()
+		return fmt.Errorf("failed to start admin server: %v", err)
 	}
+	log.Printf("Listening on %s...\n", address)
+	sctx.listener = listener
+	go sctx.signalListener(listener)
+	go sctx.eventHandler()
+	go sctx.runReaper()
+	go sctx.runQuotaScanner()
+	return nil
+}
+
+// Serve accepts connections until the server is stopped.
+func (sctx *SshServerContext) Serve() {
+	listener := sctx.listener
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
@@ -73,13 +126,21 @@ func (sctx *SshServerContext) Serve(address string) {
 			log.Println("Failed to accept connection:", err)
 			continue
 		}
+		if sctx.draining.Load() {
+			log.Printf("Refused connection from %v: draining", conn.RemoteAddr())
+			_ = conn.Close()
+			continue
+		}
 		connCtx := &SshConnContext{
 			ServerContext: sctx,
 			context:       sctx.context,
 			Conn:          nil,
 			EventBus:      eventbus.New(),
+			SessionId:     sctx.sessionIds.Add(1),
+			Connected:     time.Now(),
+			notices:       make(chan string, noticeBacklog),
 		}
-		go connCtx.handleConnection(conn, sshConfig)
+		go connCtx.handleConnection(conn, sctx.serverConfig.Load())
 	}
 }
 
@@ -94,28 +155,36 @@ func (sctx *SshServerContext) signalListener(listener net.Listener) {
 }
 
 func (sctx *SshServerContext) eventHandler() {
-	openedPorts := make(map[int]*struct{})
 	err := sctx.EventBus.Subscribe(ConnectionEstablishedEvent, func(_ string, _ *daemon.ServerEvent) {
 		sctx.wg.Add(1)
+		sctx.connections.Add(1)
 	})
 	if err != nil {
 		panic(err)
 	}
 	err = sctx.EventBus.Subscribe(ConnectionCloseEvent, func(_ string, _ *daemon.ServerEvent) {
 		sctx.wg.Add(-1)
+		sctx.connections.Add(-1)
+	})
+	if err != nil {
+		panic(err)
+	}
+	err = sctx.EventBus.Subscribe(SessionAttachedEvent, func(_ string, ev *daemon.ServerEvent) {
+		sctx.Workspaces.attach(ConnectionEvent(ev))
 	})
 	if err != nil {
 		panic(err)
 	}
-	err = sctx.EventBus.Subscribe(forwarder.PortForwardRequestEvent, func(_ string, ev *daemon.ServerEvent) {
-		from, to, dst := forwarder.ForwardRequest(ev)
-		log.Println("Received port forwarding request from ", dst, ": (host)", from, " -> (guest)", to)
-		if _, ok := openedPorts[from]; ok {
-			log.Println("Port conflict: ", from, " -> ", to)
-			return
+	err = sctx.EventBus.Subscribe(ConnectionCloseEvent, func(_ string, ev *daemon.ServerEvent) {
+		if conn := ConnectionEvent(ev); conn.ContainerId != "" {
+			sctx.Workspaces.detach(conn)
 		}
-		openedPorts[from] = &struct{}{}
-		go forwarder.PortForward(sctx.context, dst, from, to)
+	})
+	if err != nil {
+		panic(err)
+	}
+	err = sctx.EventBus.Subscribe(manager.ManagerContainerRemovedEvent, func(_ string, ev *daemon.ServerEvent) {
+		sctx.Workspaces.forget(manager.ContainerRemovedEvent(ev))
 	})
 	if err != nil {
 		panic(err)
@@ -123,12 +192,48 @@ func (sctx *SshServerContext) eventHandler() {
 }
 
 func (sctx *SshServerContext) StopSshServer() {
+	if sctx.Broadcast("The server is shutting down, your session will be closed.") > 0 {
+		// give the notice time to reach clients before their connections are closed.
+		time.Sleep(time.Second)
+	}
 	sctx.cancel()
 	sctx.wg.Wait()
+	sctx.Audit.Close()
+}
+
+// SetDraining starts or stops refusing new connections.
+func (sctx *SshServerContext) SetDraining(draining bool) {
+	sctx.draining.Store(draining)
+}
+
+func (sctx *SshServerContext) IsDraining() bool {
+	return sctx.draining.Load()
 }
 
-func (sctx *SshServerContext) GetHostWorkspaceDir(user string) string {
-	return filepath.Join(sctx.AppConfig.WorkspaceParent, user)
+// Connections counts open SSH connections, including those not attached to a workspace yet.
+func (sctx *SshServerContext) Connections() int64 {
+	return sctx.connections.Load()
+}
+
+// WorkspaceVars resolves the template variables of a user connecting with the named key.
+func (sctx *SshServerContext) WorkspaceVars(user string, key string) *daemon.TemplateVars {
+	return sctx.AppConfig.Load().WorkspaceVars(user, key)
+}
+
+// WorkspaceTemplate finds the template of a user and expands it for the named key.
+func (sctx *SshServerContext) WorkspaceTemplate(user string, key string) (*daemon.ContainerConfig, *daemon.TemplateVars, error) {
+	config := sctx.AppConfig.Load()
+	containerTemplate, err := config.TemplateOf(user)
+	if err != nil {
+		return nil, nil, err
+	}
+	vars := config.WorkspaceVars(user, key)
+	containerTemplate = containerTemplate.Expand(vars)
+	if err = config.ValidateMounts(containerTemplate); err != nil {
+		return nil, nil, err
+	}
+	containerTemplate.Mounts = append(containerTemplate.Mounts, config.GroupMounts(key)...)
+	return containerTemplate, vars, nil
 }
 
 func loadPrivateKey(path string) ssh.Signer {
@@ -143,6 +248,39 @@ func loadPrivateKey(path string) ssh.Signer {
 	return private
 }
 
+// authRejectedError is returned for a key or user name refused by the auth callbacks. Clients offer each of their
+// keys before picking one, so a rejection is only recorded when the connection ends without authenticating.
+type authRejectedError struct {
+	user        string
+	key         string
+	fingerprint string
+	err         error
+}
+
+func (e *authRejectedError) Error() string {
+	return e.err.Error()
+}
+
+// recordAuthFailure records a connection which ended without authenticating, with the last key it was refused.
+// Handshakes failing before authentication, e.g. of port scanners, aren't recorded.
+func recordAuthFailure(auditor *audit.Logger, remote string, err error) {
+	var authErr *ssh.ServerAuthError
+	if !errors.As(err, &authErr) {
+		return
+	}
+	record := audit.Record{Type: audit.AuthFailure, Remote: remote, Error: err.Error()}
+	for _, e := range authErr.Errors {
+		var rejected *authRejectedError
+		if errors.As(e, &rejected) {
+			record.User = rejected.user
+			record.Key = rejected.key
+			record.Fingerprint = rejected.fingerprint
+			record.Error = rejected.Error()
+		}
+	}
+	auditor.Record(record)
+}
+
 func setupSSHConfig(private ssh.Signer, config *daemon.Config) *ssh.ServerConfig {
 	namedKeys := make(map[string][]ssh.PublicKey)
 	for k, v := range config.Keys {
@@ -159,9 +297,10 @@ func setupSSHConfig(private ssh.Signer, config *daemon.Config) *ssh.ServerConfig
 	}
 	var sshConfig *ssh.ServerConfig
 	if len(namedKeys) != 0 {
-		sshConfig = &ssh.ServerConfig{PublicKeyCallback: func(conn ssh.ConnMetadata, incomingKey ssh.PublicKey) (*ssh.Permissions, error) {
-			if incomingKey == nil {
-				return nil, fmt.Errorf("unauthorized: key not present")
+		authenticate := func(conn ssh.ConnMetadata, incomingKey ssh.PublicKey) (string, *ssh.Permissions, error) {
+			user, err := config.NormalizeUser(conn.User())
+			if err != nil {
+				return "", nil, fmt.Errorf("unauthorized: %v", err)
 			}
 			for name, allowedKeys := range namedKeys {
 				for i := range allowedKeys {
@@ -171,43 +310,125 @@ func setupSSHConfig(private ssh.Signer, config *daemon.Config) *ssh.ServerConfig
 						continue
 					}
 					if bytes.Equal(key.Marshal(), incomingKey.Marshal()) {
+						permissions := &ssh.Permissions{Extensions: map[string]string{
+							keyNameExtension:        name,
+							keyFingerprintExtension: ssh.FingerprintSHA256(incomingKey),
+							userNameExtension:       user,
+						}}
+						if config.IsWorkspaceMember(user, name) {
+							return name, permissions, nil
+						}
 						access, exists := config.AccessControl[name]
 						if !exists {
-							return nil, fmt.Errorf("unauthorized: acl not set")
+							return name, nil, fmt.Errorf("unauthorized: acl not set")
 						}
-						if access.CanAccess(conn.User()) {
-							return nil, nil
+						if access.CanAccess(user) {
+							return name, permissions, nil
 						}
-						return nil, fmt.Errorf("unauthorized: access not granted")
+						return name, nil, fmt.Errorf("unauthorized: access not granted")
 					}
 				}
 			}
-			return nil, fmt.Errorf("unauthorized: incomingKey not enrolled.")
+			return "", nil, fmt.Errorf("unauthorized: incomingKey not enrolled.")
+		}
+		sshConfig = &ssh.ServerConfig{PublicKeyCallback: func(conn ssh.ConnMetadata, incomingKey ssh.PublicKey) (*ssh.Permissions, error) {
+			if incomingKey == nil {
+				return nil, fmt.Errorf("unauthorized: key not present")
+			}
+			name, permissions, err := authenticate(conn, incomingKey)
+			if err != nil {
+				// recorded by handleConnection if no other key is accepted, see recordAuthFailure.
+				return nil, &authRejectedError{user: conn.User(), key: name, fingerprint: ssh.FingerprintSHA256(incomingKey), err: err}
+			}
+			return permissions, nil
 		}}
 	} else {
 		log.Println("NO CLIENT AUTH IS ENABLED! YOU SHALL ONLY USE THIS IN TEST ENVIRONMENT.")
 		sshConfig = &ssh.ServerConfig{
 			NoClientAuth: true,
+			NoClientAuthCallback: func(conn ssh.ConnMetadata) (*ssh.Permissions, error) {
+				user, err := config.NormalizeUser(conn.User())
+				if err != nil {
+					// recorded by handleConnection, see recordAuthFailure.
+					return nil, &authRejectedError{user: conn.User(), err: fmt.Errorf("unauthorized: %v", err)}
+				}
+				return &ssh.Permissions{Extensions: map[string]string{userNameExtension: user}}, nil
+			},
 		}
 	}
+	// authentication errors never reach the client, so explain rejected user names in the banner.
+	sshConfig.BannerCallback = func(conn ssh.ConnMetadata) string {
+		if _, err := config.NormalizeUser(conn.User()); err != nil {
+			log.Printf("Rejecting user name %q from %v: %v", conn.User(), conn.RemoteAddr(), err)
+			return fmt.Sprintf("Invalid user name %q: %v\r\n", conn.User(), err)
+		}
+		return ""
+	}
 	sshConfig.AddHostKey(private)
 
 	return sshConfig
 }
 
-func (sctx *SshServerContext) PrepareContainer(containerName string, workspaceDir string, containerTemplate *daemon.ContainerConfig) (*string, error, bool) {
+// PrepareContainer finds or creates the container. Progress of long-running steps like image pulls is sent to report.
+func (sctx *SshServerContext) PrepareContainer(vars *daemon.TemplateVars, containerTemplate *daemon.ContainerConfig, report func(string)) (*string, error, bool) {
 	dockerClient := sctx.DockerClient
+	config := sctx.AppConfig.Load()
+	containerName := vars.Workspace
 	exists, status, containerID := daemon.ContainerExists(dockerClient, containerName)
 	isNew := false
 	if !exists {
+		if vars.WorkspaceDir != "" {
+			if err := daemon.InitWorkspaceDir(vars.WorkspaceDir, containerTemplate.WorkspaceOwner); err != nil {
+				return nil, fmt.Errorf("failed to prepare workspace directory: %v", err), false
+			}
+		}
+		if containerTemplate.Build != nil {
+			image, err := daemon.EnsureBuiltImage(sctx.context, dockerClient, containerTemplate.Build, report)
+			if err != nil {
+				return nil, err, false
+			}
+			containerTemplate.Image = image
+		} else {
+			err := daemon.EnsureImage(sctx.context, dockerClient, containerTemplate.Image, containerTemplate.PullPolicy, config.Registries, report)
+			if err != nil {
+				return nil, err, false
+			}
+		}
+		labels := map[string]string{
+			daemon.LabelWorkspace: containerName,
+			daemon.LabelTemplate:  containerTemplate.Name,
+			daemon.LabelUser:      vars.User,
+			daemon.LabelKey:       vars.Key,
+		}
+		createTemplate := containerTemplate
+		if containerTemplate.EnableManager {
+			token, err := daemon.NewManagerToken()
+			if err != nil {
+				return nil, err, false
+			}
+			labels[daemon.LabelManagerTokenHash] = daemon.HashManagerToken(token)
+			// copied so the token doesn't leak into the template of other connections.
+			withToken := *containerTemplate
+			withToken.Env = append(append([]string{}, containerTemplate.Env...), daemon.ManagerTokenEnv+"="+token)
+			if socketDir := config.ManagerSocketDir(containerName); socketDir != "" {
+				// the directory is mounted rather than the socket, so the daemon can recreate the socket.
+				if err := os.MkdirAll(socketDir, 0755); err != nil {
+					return nil, fmt.Errorf("failed to create manager socket directory: %v", err), false
+				}
+				withToken.Volumes = append(append([]string{}, containerTemplate.Volumes...), socketDir+":"+daemon.ManagerSocketTarget)
+				withToken.Env = append(withToken.Env, daemon.ManagerSocketEnv+"="+path.Join(daemon.ManagerSocketTarget, daemon.ManagerSocketName))
+			}
+			createTemplate = &withToken
+		}
 		_containerID, err := daemon.CreateContainerFromTemplate(
 			dockerClient,
 			containerName,
-			workspaceDir,
-			sctx.AppConfig.GlobalShareDir,
-			sctx.AppConfig.Network,
-			sctx.AppConfig.Runtime,
-			containerTemplate,
+			vars.WorkspaceDir,
+			config.GlobalShareDir,
+			config.Network,
+			config.Runtime,
+			createTemplate,
+			labels,
 		)
 		if err != nil {
 			log.Println("Failed to create container: ", err)
@@ -216,7 +437,14 @@ func (sctx *SshServerContext) PrepareContainer(containerName string, workspaceDi
 		}
 		containerID = _containerID
 		isNew = true
+		err = daemon.RunHooks(sctx.context, dockerClient, containerID, containerTemplate, daemon.HookPostCreate, vars, report)
+		if err != nil {
+			// remove it so the hooks are given another chance on the next connection.
+			_ = daemon.DestroyContainer(sctx.context, dockerClient, containerID)
+			return nil, err, false
+		}
 	}
+	started := isNew
 	if status != "" {
 		switch status {
 		case daemon.ContainerStatusCreated, daemon.ContainerStatusPaused, daemon.ContainerStatusRunning, daemon.ContainerStatusUp:
@@ -225,15 +453,22 @@ func (sctx *SshServerContext) PrepareContainer(containerName string, workspaceDi
 			// Workaround from issue: https://github.com/docker/cli/issues/1891#issuecomment-581486695
 			// This issue also occurs when you are using normal `docker stop` commands.
 			// so let's disconnect it first.
-			_ = sctx.DockerClient.NetworkDisconnect(sctx.context, sctx.AppConfig.Network, containerID, true)
+			_ = sctx.DockerClient.NetworkDisconnect(sctx.context, config.Network, containerID, true)
 			err := sctx.DockerClient.ContainerStart(sctx.context, containerID, container.StartOptions{})
 			if err != nil {
 				return nil, fmt.Errorf("failed to start container: %v", err), false
 			}
+			started = true
 			break
 		default:
 			return nil, fmt.Errorf("unexpected container status: %v", status), false
 		}
 	}
+	if started {
+		err := daemon.RunHooks(sctx.context, dockerClient, containerID, containerTemplate, daemon.HookPostStart, vars, report)
+		if err != nil {
+			return nil, err, isNew
+		}
+	}
 	return &containerID, nil, isNew
 }
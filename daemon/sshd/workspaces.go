@@ -0,0 +1,122 @@
+package sshd
+
+import (
+	"bubble/daemon"
+	"sort"
+	"sync"
+	"time"
+)
+
+// workspaceState is what bubble knows about a running workspace container.
+type workspaceState struct {
+	containerId string
+	name        string
+	template    *daemon.ContainerConfig
+	sessions    map[*SshConnContext]struct{}
+	lastActive  time.Time
+	stopped     bool
+	warned      bool
+}
+
+// WorkspaceRegistry tracks sessions attached to each workspace container and when they were last active.
+type WorkspaceRegistry struct {
+	lock       sync.Mutex
+	workspaces map[string]*workspaceState
+}
+
+func newWorkspaceRegistry() *WorkspaceRegistry {
+	return &WorkspaceRegistry{
+		workspaces: make(map[string]*workspaceState),
+	}
+}
+
+// track starts tracking a container, if it isn't tracked yet.
+func (r *WorkspaceRegistry) track(containerId string, name string, template *daemon.ContainerConfig) *workspaceState {
+	state, ok := r.workspaces[containerId]
+	if !ok {
+		state = &workspaceState{
+			containerId: containerId,
+			name:        name,
+			template:    template,
+			sessions:    make(map[*SshConnContext]struct{}),
+			lastActive:  time.Now(),
+		}
+		r.workspaces[containerId] = state
+	}
+	return state
+}
+
+func (r *WorkspaceRegistry) attach(conn *SshConnContext) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	state := r.track(conn.ContainerId, conn.Workspace, conn.Template)
+	state.template = conn.Template
+	state.sessions[conn] = struct{}{}
+	state.touch()
+}
+
+func (r *WorkspaceRegistry) detach(conn *SshConnContext) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if state, ok := r.workspaces[conn.ContainerId]; ok {
+		delete(state.sessions, conn)
+		state.touch()
+	}
+}
+
+func (r *WorkspaceRegistry) forget(containerId string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.workspaces, containerId)
+}
+
+// Touch records activity in a workspace, e.g. input from a user, output of a session or a new exec.
+func (r *WorkspaceRegistry) Touch(containerId string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if state, ok := r.workspaces[containerId]; ok {
+		state.touch()
+	}
+}
+
+// Sessions lists connections attached to a container.
+func (r *WorkspaceRegistry) Sessions(containerId string) []*SshConnContext {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	state, ok := r.workspaces[containerId]
+	if !ok {
+		return nil
+	}
+	sessions := make([]*SshConnContext, 0, len(state.sessions))
+	for conn := range state.sessions {
+		sessions = append(sessions, conn)
+	}
+	sortSessions(sessions)
+	return sessions
+}
+
+// AllSessions returns sessions of every workspace, ordered by session id.
+func (r *WorkspaceRegistry) AllSessions() []*SshConnContext {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var sessions []*SshConnContext
+	for _, state := range r.workspaces {
+		for conn := range state.sessions {
+			sessions = append(sessions, conn)
+		}
+	}
+	sortSessions(sessions)
+	return sessions
+}
+
+func sortSessions(sessions []*SshConnContext) {
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].SessionId < sessions[j].SessionId
+	})
+}
+
+func (state *workspaceState) touch() {
+	state.lastActive = time.Now()
+	state.stopped = false
+	state.warned = false
+}
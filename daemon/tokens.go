@@ -0,0 +1,74 @@
+package daemon
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+)
+
+// LabelManagerTokenHash holds the SHA-256 of the secret a container presents to the manager server, so that
+// anyone allowed to inspect containers can't read it. The secret itself is given only to the container,
+// as $BUBBLE_MANAGER_TOKEN.
+const (
+	LabelManagerTokenHash = "bubble.manager-token-sha256"
+	ManagerTokenEnv       = "BUBBLE_MANAGER_TOKEN"
+)
+
+// The manager socket of a container is found at ManagerSocketEnv, inside ManagerSocketTarget.
+const (
+	ManagerSocketTarget = "/run/bubble"
+	ManagerSocketName   = "bubble.sock"
+	ManagerSocketEnv    = "BUBBLE_MANAGER_SOCKET"
+)
+
+// ManagerSocketDir is the host directory holding the manager socket of a workspace, or "" if sockets are disabled.
+func (c *Config) ManagerSocketDir(workspace string) string {
+	if c.Manager.SocketDir == "" {
+		return ""
+	}
+	return filepath.Join(c.Manager.SocketDir, workspace)
+}
+
+func NewManagerToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate manager token: %v", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// IsManagerToken tells whether token has the format of NewManagerToken, 64 hex characters.
+func IsManagerToken(token string) bool {
+	if len(token) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(token)
+	return err == nil
+}
+
+// HashManagerToken returns the hex SHA-256 of a manager token, as stored in LabelManagerTokenHash.
+func HashManagerToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// FindContainerByTokenHash returns the id of the running container whose manager token has the hash, or "" if there is none.
+func FindContainerByTokenHash(ctx context.Context, dockerClient *client.Client, hash string) (string, error) {
+	containers, err := dockerClient.ContainerList(ctx, container.ListOptions{
+		Filters: filters.NewArgs(filters.Arg("label", LabelManagerTokenHash+"="+hash)),
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(containers) != 1 {
+		return "", nil
+	}
+	return containers[0].ID, nil
+}
@@ -0,0 +1,107 @@
+package daemon
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const defaultUserNameMaxLength = 32
+
+// validUserName keeps names usable as a path segment, a container name and a hostname.
+var validUserName = regexp.MustCompile("^[a-z0-9][a-z0-9_.-]*$")
+
+// UserNameConfig restricts which SSH user names are accepted.
+type UserNameConfig struct {
+	MaxLength int      `yaml:"max-length"`
+	Reserved  []string `yaml:"reserved"`
+}
+
+// NormalizeUser checks that an SSH user name is safe to derive a workspace from. Names aren't lower-cased
+// but rejected unless already lower case, since Alice would otherwise silently get the workspace of alice.
+func (c *Config) NormalizeUser(name string) (string, error) {
+	normalized := name
+	maxLength := c.UserNames.MaxLength
+	if maxLength <= 0 {
+		maxLength = defaultUserNameMaxLength
+	}
+	if len(normalized) == 0 {
+		return "", fmt.Errorf("user name is empty")
+	}
+	if len(normalized) > maxLength {
+		return "", fmt.Errorf("user name is longer than %v characters", maxLength)
+	}
+	if normalized != strings.ToLower(normalized) {
+		return "", fmt.Errorf("user name must be lower case")
+	}
+	if !validUserName.MatchString(normalized) {
+		return "", fmt.Errorf("user name may only contain a-z, 0-9, '_', '.' and '-', and must start with a letter or digit")
+	}
+	if strings.Contains(normalized, "..") {
+		return "", fmt.Errorf(`user name must not contain ".."`)
+	}
+	if slices.Contains(c.UserNames.Reserved, normalized) {
+		return "", fmt.Errorf("user name %v is reserved", normalized)
+	}
+	return normalized, nil
+}
+
+// WorkspaceIdOf maps an SSH user to the id of its workspace, which names the container and the data directory.
+func (c *Config) WorkspaceIdOf(user string) string {
+	if id, ok := c.WorkspaceIds[user]; ok {
+		return id
+	}
+	return user
+}
+
+// WorkspaceName names the container of a workspace id.
+func WorkspaceName(id string) string {
+	return "workspace-" + id
+}
+
+// WorkspaceVars resolves the template variables of a user connecting with the named key.
+func (c *Config) WorkspaceVars(user string, key string) *TemplateVars {
+	uid, gid := c.LookupUid(user, key)
+	id := c.WorkspaceIdOf(user)
+	return &TemplateVars{
+		User:         user,
+		Workspace:    WorkspaceName(id),
+		Key:          key,
+		WorkspaceDir: c.HostWorkspaceDir(id),
+		Uid:          uid,
+		Gid:          gid,
+	}
+}
+
+// HostWorkspaceDir returns the data directory of a workspace id, or "" if the feature is disabled.
+func (c *Config) HostWorkspaceDir(id string) string {
+	parent := c.WorkspaceParent
+	if parent == "" {
+		return ""
+	}
+	dir := filepath.Join(parent, id)
+	if filepath.Dir(dir) != parent {
+		// ids are validated at authentication, so this is a bug rather than an attack.
+		log.Printf("Refused workspace directory %v outside of %v", dir, parent)
+		return ""
+	}
+	return dir
+}
+
+func (c *Config) validateUserNames() error {
+	for i, reserved := range c.UserNames.Reserved {
+		c.UserNames.Reserved[i] = strings.ToLower(reserved)
+	}
+	for user, id := range c.WorkspaceIds {
+		if user != strings.ToLower(user) {
+			return fmt.Errorf("workspace id of %v: user names must be lower case", user)
+		}
+		if !validUserName.MatchString(id) || strings.Contains(id, "..") {
+			return fmt.Errorf("invalid workspace id %v of %v", id, user)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package daemon
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeUser(t *testing.T) {
+	config := &Config{UserNames: UserNameConfig{Reserved: []string{"admin", "root"}}}
+	tests := []struct {
+		name    string
+		user    string
+		wantErr bool
+	}{
+		{"plain", "alice", false},
+		{"digits and punctuation", "a1_b.c-d", false},
+		{"leading digit", "1alice", false},
+		{"empty", "", true},
+		{"reserved", "admin", true},
+		{"other reserved", "root", true},
+		{"dot dot", "..", true},
+		{"dot dot inside", "a..b", true},
+		{"length 32", strings.Repeat("a", 32), false},
+		{"length 33", strings.Repeat("a", 33), true},
+		{"leading dot", ".alice", true},
+		{"leading dash", "-alice", true},
+		{"leading underscore", "_alice", true},
+		{"upper case", "Alice", true},
+		{"upper case reserved", "ADMIN", true},
+		{"slash", "a/b", true},
+		{"space", "a b", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user, err := config.NormalizeUser(test.user)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("NormalizeUser(%q) = %q, expected an error", test.user, user)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("NormalizeUser(%q) failed: %v", test.user, err)
+			} else if user != test.user {
+				t.Errorf("NormalizeUser(%q) = %q", test.user, user)
+			}
+		})
+	}
+}
+
+func TestNormalizeUserMaxLength(t *testing.T) {
+	config := &Config{UserNames: UserNameConfig{MaxLength: 4}}
+	if _, err := config.NormalizeUser("abcd"); err != nil {
+		t.Errorf("name of max-length rejected: %v", err)
+	}
+	if _, err := config.NormalizeUser("abcde"); err == nil {
+		t.Errorf("name longer than max-length accepted")
+	}
+}
@@ -0,0 +1,64 @@
+package daemon
+
+import (
+	"os"
+	"strings"
+)
+
+// TemplateVars are the values which can be referenced as ${name} in env, volumes, mounts, cmd, exec, user and hooks of a template.
+type TemplateVars struct {
+	User         string
+	Workspace    string
+	Key          string
+	WorkspaceDir string
+	Uid          string
+	Gid          string
+}
+
+func (v *TemplateVars) Lookup(name string) (string, bool) {
+	switch name {
+	case "user":
+		return v.User, true
+	case "workspace":
+		return v.Workspace, true
+	case "key":
+		return v.Key, true
+	case "workspace_dir":
+		return v.WorkspaceDir, true
+	case "uid":
+		return v.Uid, true
+	case "gid":
+		return v.Gid, true
+	}
+	return "", false
+}
+
+// Expand replaces known variables in s. Unknown ones are kept so that they can still be resolved by the shell inside.
+func (v *TemplateVars) Expand(s string) string {
+	return os.Expand(s, func(name string) string {
+		if value, ok := v.Lookup(name); ok {
+			return value
+		}
+		return "${" + name + "}"
+	})
+}
+
+func (v *TemplateVars) ExpandAll(array []string) []string {
+	if array == nil {
+		return nil
+	}
+	result := make([]string, len(array))
+	for i := range array {
+		result[i] = v.Expand(array[i])
+	}
+	return result
+}
+
+// parseUidMapping splits "uid[:gid]". gid defaults to uid.
+func parseUidMapping(mapping string) (uid string, gid string) {
+	uid, gid, found := strings.Cut(mapping, ":")
+	if !found {
+		gid = uid
+	}
+	return uid, gid
+}
@@ -0,0 +1,4 @@
+package daemon
+
+// Version of bubble, set at build time with -ldflags "-X bubble/daemon.Version=...".
+var Version = "dev"
@@ -0,0 +1,46 @@
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// InitWorkspaceDir creates the data directory of a workspace. If bubble is the one creating it,
+// the directory is handed to owner ("uid[:gid]") so the container user can write to it.
+// An owner that expanded to nothing, e.g. "${uid}:${gid}" of a user missing from uid-map, leaves it to root.
+func InitWorkspaceDir(dir string, owner string) error {
+	uid, gid, err := parseOwner(owner)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if uid < 0 {
+		return nil
+	}
+	return os.Chown(dir, uid, gid)
+}
+
+// parseOwner parses "uid[:gid]", returning -1 for an empty owner.
+func parseOwner(owner string) (uid int, gid int, err error) {
+	if owner == "" || owner == ":" {
+		return -1, -1, nil
+	}
+	uidString, gidString := parseUidMapping(owner)
+	uid, err = strconv.Atoi(uidString)
+	if err != nil || uid < 0 {
+		return 0, 0, fmt.Errorf("invalid workspace owner %q", owner)
+	}
+	gid, err = strconv.Atoi(gidString)
+	if err != nil || gid < 0 {
+		return 0, 0, fmt.Errorf("invalid workspace owner %q", owner)
+	}
+	return uid, gid, nil
+}